@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// Kinds of alert rules.
+const (
+	// RuleHopperLow fires when the hopper level, in %, is below Threshold.
+	RuleHopperLow = "hopper_low"
+	// RuleFeedingFailed fires on a feeding_missed or feeding_failed event,
+	// and when a scheduled feeding is overdue by For.
+	RuleFeedingFailed = "feeding_failed"
+	// RuleOffline fires when a device stays offline for For.
+	RuleOffline = "offline"
+	// RuleTemperatureHigh and RuleTemperatureLow fire when the temperature,
+	// in °C, is above or below Threshold.
+	RuleTemperatureHigh = "temperature_high"
+	RuleTemperatureLow  = "temperature_low"
+)
+
+// Alert states.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// alertInterval is how often the rules are evaluated.
+const alertInterval = 15 * time.Second
+
+var errInvalidRule = errors.New("invalid alert rule")
+
+// QuietHours is a daily period, in the local time of the dashboard, during
+// which only critical alerts are sent. The others wait for its end and are
+// dropped if resolved meanwhile. End may be before Start, e.g. 22:00-07:00.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Rule is a condition on the state or the events of the feeders.
+type Rule struct {
+	Name      string      `json:"name"`
+	Kind      string      `json:"kind"`
+	Devices   []string    `json:"devices,omitempty"`
+	Threshold float64     `json:"threshold,omitempty"`
+	For       Duration    `json:"for,omitempty"`
+	Priority  string      `json:"priority,omitempty"`
+	Quiet     *QuietHours `json:"quiet,omitempty"`
+	Sinks     []string    `json:"sinks,omitempty"`
+}
+
+// Alert is the notification of a rule firing or resolving for a device.
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Kind     string    `json:"kind"`
+	Device   string    `json:"device"`
+	Name     string    `json:"name,omitempty"`
+	State    string    `json:"state"`
+	Message  string    `json:"message"`
+	Priority uint8     `json:"priority"`
+	Since    time.Time `json:"since"`
+	Time     time.Time `json:"time"`
+}
+
+// AlertConfig is the "alerts" section of the configuration, without rules
+// the DefaultRules apply.
+type AlertConfig struct {
+	Sinks map[string]SinkConfig `json:"sinks,omitempty"`
+	Rules []Rule                `json:"rules,omitempty"`
+}
+
+var DefaultRules = []Rule{
+	{Name: "hopper low", Kind: RuleHopperLow, Threshold: 15, For: Duration(30 * time.Minute)},
+	{Name: "feeding failed", Kind: RuleFeedingFailed, For: Duration(15 * time.Minute)},
+	{Name: "offline", Kind: RuleOffline},
+	{Name: "too hot", Kind: RuleTemperatureHigh, Threshold: 28, For: Duration(10 * time.Minute), Priority: "critical"},
+}
+
+var priorities = map[string]uint8{
+	"info":     protocol.PriorityInfo,
+	"warning":  protocol.PriorityWarning,
+	"critical": protocol.PriorityCritical,
+}
+
+func (r *Rule) validate(sinks map[string]Sink) error {
+	fail := func(msg string) error {
+		return fmt.Errorf("%w %q: %s", errInvalidRule, r.Name, msg)
+	}
+	if r.Name == "" {
+		return fail("missing name")
+	}
+	switch r.Kind {
+	case RuleHopperLow, RuleFeedingFailed, RuleOffline, RuleTemperatureHigh, RuleTemperatureLow:
+	default:
+		return fail("unknown kind " + r.Kind)
+	}
+	if r.For < 0 {
+		return fail("negative duration")
+	}
+	if _, ok := priorities[r.Priority]; r.Priority != "" && !ok {
+		return fail("priority must be info, warning or critical")
+	}
+	if r.Quiet != nil {
+		if _, err := time.Parse("15:04", r.Quiet.Start); err != nil {
+			return fail("quiet start must be HH:MM")
+		}
+		if _, err := time.Parse("15:04", r.Quiet.End); err != nil {
+			return fail("quiet end must be HH:MM")
+		}
+	}
+	for _, s := range r.Sinks {
+		if _, ok := sinks[s]; !ok {
+			return fail("unknown sink " + s)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) priority() uint8 {
+	if p, ok := priorities[r.Priority]; ok {
+		return p
+	}
+	if r.Kind == RuleTemperatureHigh || r.Kind == RuleTemperatureLow {
+		return protocol.PriorityCritical
+	}
+	return protocol.PriorityWarning
+}
+
+func (r *Rule) applies(id string) bool {
+	if len(r.Devices) == 0 {
+		return true
+	}
+	for _, d := range r.Devices {
+		if d == id {
+			return true
+		}
+	}
+	return false
+}
+
+// quiet reports whether t is in the quiet hours of the rule.
+func (r *Rule) quiet(t time.Time) bool {
+	if r.Quiet == nil {
+		return false
+	}
+	start, _ := time.Parse("15:04", r.Quiet.Start)
+	end, _ := time.Parse("15:04", r.Quiet.End)
+	m := t.Hour()*60 + t.Minute()
+	s, e := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if s <= e {
+		return m >= s && m < e
+	}
+	return m >= s || m < e
+}
+
+// alertState tracks a rule for a device: pending since a time, firing once
+// that lasted For, and whether the firing was notified.
+type alertState struct {
+	alert    Alert
+	firing   bool
+	notified bool
+	// oneShot alerts come from events, they have nothing to resolve.
+	oneShot bool
+}
+
+// Alerter evaluates the rules against the feeders and sends the alerts to
+// the sinks. Every alert is logged, with or without sinks.
+type Alerter struct {
+	rules []Rule
+	sinks map[string]Sink
+
+	mu     sync.Mutex
+	states map[string]*alertState
+}
+
+func NewAlerter(cfg AlertConfig) (*Alerter, error) {
+	if len(cfg.Rules) == 0 {
+		cfg.Rules = DefaultRules
+	}
+	a := &Alerter{
+		rules:  append([]Rule(nil), cfg.Rules...),
+		sinks:  make(map[string]Sink),
+		states: make(map[string]*alertState),
+	}
+	for name, sc := range cfg.Sinks {
+		s, err := NewSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", name, err)
+		}
+		a.sinks[name] = s
+	}
+	names := make(map[string]bool)
+	for i := range a.rules {
+		r := &a.rules[i]
+		if err := r.validate(a.sinks); err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("%w %q: duplicated name", errInvalidRule, r.Name)
+		}
+		names[r.Name] = true
+	}
+	return a, nil
+}
+
+// Run evaluates the rules against the hub until the process exits.
+func (a *Alerter) Run(h *Hub) {
+	for {
+		a.Evaluate(time.Now(), h.List())
+		time.Sleep(alertInterval)
+	}
+}
+
+// Evaluate checks the state rules of every feeder and sends the alerts
+// that changed, or that were held during quiet hours.
+func (a *Alerter) Evaluate(now time.Time, feeders []Feeder) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.rules {
+		r := &a.rules[i]
+		for j := range feeders {
+			f := &feeders[j]
+			if !r.applies(f.ID) {
+				continue
+			}
+			active, message := condition(r, f, now)
+			a.update(r, f, now, active, message)
+		}
+	}
+	a.flush(now)
+}
+
+// Event checks the event rules, which fire immediately.
+func (a *Alerter) Event(f Feeder, ev protocol.Event, now time.Time) {
+	kind := ev.Kind()
+	if kind != "feeding_missed" && kind != "feeding_failed" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.rules {
+		r := &a.rules[i]
+		if r.Kind != RuleFeedingFailed || !r.applies(f.ID) {
+			continue
+		}
+		key := r.Name + "/" + f.ID + "/" + kind + "/" + now.Format(time.RFC3339Nano)
+		a.states[key] = &alertState{
+			alert:   a.newAlert(r, &f, now, ev.Message),
+			firing:  true,
+			oneShot: true,
+		}
+	}
+	a.flush(now)
+}
+
+// Forget drops the alerts of a forgotten device, without notifying.
+func (a *Alerter) Forget(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, s := range a.states {
+		if s.alert.Device == id {
+			delete(a.states, key)
+		}
+	}
+}
+
+// Active returns the firing alerts, sorted by device and rule.
+func (a *Alerter) Active() []Alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := []Alert{}
+	for _, s := range a.states {
+		if s.firing && !s.oneShot {
+			list = append(list, s.alert)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Device != list[j].Device {
+			return list[i].Device < list[j].Device
+		}
+		return list[i].Rule < list[j].Rule
+	})
+	return list
+}
+
+// condition reports whether the state rule holds for the feeder, ignoring
+// its duration.
+func condition(r *Rule, f *Feeder, now time.Time) (bool, string) {
+	switch r.Kind {
+	case RuleOffline:
+		if f.LastSeen.IsZero() {
+			// restored from the store, not seen since the dashboard started
+			return false, ""
+		}
+		return stateOf(f, now) == StateOffline,
+			"no message since " + f.LastSeen.Format(time.RFC3339)
+	case RuleFeedingFailed:
+		for i, al := range f.Schedule {
+			next := time.Unix(al.Next, 0)
+			if al.Enabled && al.Next != 0 && now.After(next) {
+				return true, fmt.Sprintf("feeding %d scheduled at %s not done", i, next.Format(time.RFC3339))
+			}
+		}
+		return false, ""
+	}
+
+	if f.Sensors == nil {
+		return false, ""
+	}
+	s := sampleFromState(now, f.Sensors)
+	switch r.Kind {
+	case RuleHopperLow:
+		if s.Level != nil && float64(*s.Level) < r.Threshold {
+			return true, fmt.Sprintf("hopper at %d%%", *s.Level)
+		}
+	case RuleTemperatureHigh:
+		if s.Temperature != nil && float64(*s.Temperature) > r.Threshold {
+			return true, fmt.Sprintf("temperature %.1f °C above %.1f °C", *s.Temperature, r.Threshold)
+		}
+	case RuleTemperatureLow:
+		if s.Temperature != nil && float64(*s.Temperature) < r.Threshold {
+			return true, fmt.Sprintf("temperature %.1f °C below %.1f °C", *s.Temperature, r.Threshold)
+		}
+	}
+	return false, ""
+}
+
+func (a *Alerter) update(r *Rule, f *Feeder, now time.Time, active bool, message string) {
+	key := r.Name + "/" + f.ID
+	s, ok := a.states[key]
+	if !active {
+		if !ok {
+			return
+		}
+		delete(a.states, key)
+		if s.notified {
+			resolved := s.alert
+			resolved.State = AlertResolved
+			resolved.Message = "resolved: " + s.alert.Message
+			resolved.Time = now
+			a.send(r, resolved)
+		}
+		return
+	}
+	if !ok {
+		s = &alertState{alert: a.newAlert(r, f, now, message)}
+		a.states[key] = s
+	}
+	s.alert.Message = message
+	if !s.firing && now.Sub(s.alert.Since) >= time.Duration(r.For) {
+		s.firing = true
+		s.alert.Time = now
+	}
+}
+
+func (a *Alerter) newAlert(r *Rule, f *Feeder, now time.Time, message string) Alert {
+	name := f.Name
+	if name == "" {
+		name = f.Device.Name
+	}
+	return Alert{
+		Rule:     r.Name,
+		Kind:     r.Kind,
+		Device:   f.ID,
+		Name:     name,
+		State:    AlertFiring,
+		Message:  message,
+		Priority: r.priority(),
+		Since:    now,
+		Time:     now,
+	}
+}
+
+// flush sends the firing alerts not notified yet, unless quiet hours hold
+// them back.
+func (a *Alerter) flush(now time.Time) {
+	for key, s := range a.states {
+		if !s.firing || s.notified {
+			continue
+		}
+		r := a.rule(s.alert.Rule)
+		if r == nil {
+			delete(a.states, key)
+			continue
+		}
+		if s.alert.Priority < protocol.PriorityCritical && r.quiet(now.Local()) {
+			continue
+		}
+		s.notified = true
+		a.send(r, s.alert)
+		if s.oneShot {
+			delete(a.states, key)
+		}
+	}
+}
+
+func (a *Alerter) rule(name string) *Rule {
+	for i := range a.rules {
+		if a.rules[i].Name == name {
+			return &a.rules[i]
+		}
+	}
+	return nil
+}
+
+// send logs the alert and hands it to the sinks of the rule, all of them
+// when it names none, without blocking the evaluation.
+func (a *Alerter) send(r *Rule, al Alert) {
+	log.Printf("ALERT %s %s %s: %s\n", strings.ToUpper(al.State), al.Device, al.Rule, al.Message)
+	names := r.Sinks
+	if len(names) == 0 {
+		for name := range a.sinks {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		go func(name string, s Sink) {
+			if err := s.Notify(al); err != nil {
+				log.Printf("ALERT sink %s: %s\n", name, err)
+			}
+		}(name, a.sinks[name])
+	}
+}
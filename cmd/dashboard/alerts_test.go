@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// recordSink sends the notified alerts on the channel.
+type recordSink chan Alert
+
+func (s recordSink) Notify(a Alert) error {
+	s <- a
+	return nil
+}
+
+// newTestAlerter returns an alerter with the rules and a single recordSink.
+func newTestAlerter(t *testing.T, rules ...Rule) (*Alerter, recordSink) {
+	t.Helper()
+	a, err := NewAlerter(AlertConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := make(recordSink, 10)
+	a.sinks["test"] = sink
+	return a, sink
+}
+
+// expect waits for the next notified alert, nothing when state is empty.
+func expect(t *testing.T, sink recordSink, state string) Alert {
+	t.Helper()
+	if state == "" {
+		select {
+		case al := <-sink:
+			t.Fatalf("unexpected %s alert: %s", al.State, al.Message)
+		case <-time.After(20 * time.Millisecond):
+		}
+		return Alert{}
+	}
+	select {
+	case al := <-sink:
+		if al.State != state {
+			t.Fatalf("got a %s alert, want %s: %s", al.State, state, al.Message)
+		}
+		return al
+	case <-time.After(time.Second):
+		t.Fatalf("no %s alert", state)
+	}
+	return Alert{}
+}
+
+// hopperAt returns a feeder whose hopper is at level %.
+func hopperAt(level uint8) []Feeder {
+	return []Feeder{{ID: "rabbitf3", Sensors: &protocol.SensorState{Level: &level}}}
+}
+
+func TestEvaluateFor(t *testing.T) {
+	a, sink := newTestAlerter(t, Rule{Name: "hopper low", Kind: RuleHopperLow, Threshold: 15, For: Duration(30 * time.Minute)})
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+
+	a.Evaluate(t0, hopperAt(10))
+	a.Evaluate(t0.Add(29*time.Minute), hopperAt(10))
+	expect(t, sink, "")
+	if n := len(a.Active()); n != 0 {
+		t.Fatalf("%d active alerts before the duration", n)
+	}
+
+	a.Evaluate(t0.Add(30*time.Minute), hopperAt(12))
+	al := expect(t, sink, AlertFiring)
+	if !al.Since.Equal(t0) || !al.Time.Equal(t0.Add(30*time.Minute)) || al.Message != "hopper at 12%" {
+		t.Errorf("alert %+v", al)
+	}
+	if active := a.Active(); len(active) != 1 || active[0].Device != "rabbitf3" {
+		t.Errorf("active %+v", active)
+	}
+	// notified once
+	a.Evaluate(t0.Add(31*time.Minute), hopperAt(12))
+	expect(t, sink, "")
+
+	a.Evaluate(t0.Add(40*time.Minute), hopperAt(80))
+	al = expect(t, sink, AlertResolved)
+	if al.Message != "resolved: hopper at 12%" || !al.Time.Equal(t0.Add(40*time.Minute)) {
+		t.Errorf("resolved %+v", al)
+	}
+	if n := len(a.Active()); n != 0 {
+		t.Errorf("%d active alerts once resolved", n)
+	}
+}
+
+// TestEvaluateRearm checks that a resolved alert waits the whole duration
+// again before firing, and that an interruption restarts the duration.
+func TestEvaluateRearm(t *testing.T) {
+	a, sink := newTestAlerter(t, Rule{Name: "hopper low", Kind: RuleHopperLow, Threshold: 15, For: Duration(10 * time.Minute)})
+	t0 := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+
+	a.Evaluate(t0, hopperAt(10))
+	a.Evaluate(t0.Add(10*time.Minute), hopperAt(10))
+	expect(t, sink, AlertFiring)
+	a.Evaluate(t0.Add(15*time.Minute), hopperAt(90))
+	expect(t, sink, AlertResolved)
+
+	a.Evaluate(t0.Add(20*time.Minute), hopperAt(10))
+	a.Evaluate(t0.Add(25*time.Minute), hopperAt(90))
+	a.Evaluate(t0.Add(26*time.Minute), hopperAt(10))
+	a.Evaluate(t0.Add(35*time.Minute), hopperAt(10))
+	expect(t, sink, "")
+
+	a.Evaluate(t0.Add(36*time.Minute), hopperAt(10))
+	if al := expect(t, sink, AlertFiring); !al.Since.Equal(t0.Add(26 * time.Minute)) {
+		t.Errorf("since %s, want the last time it became low", al.Since)
+	}
+}
+
+func TestEvaluateQuietHours(t *testing.T) {
+	quiet := &QuietHours{Start: "22:00", End: "07:00"}
+	a, sink := newTestAlerter(t,
+		Rule{Name: "hopper low", Kind: RuleHopperLow, Threshold: 15, Quiet: quiet},
+		Rule{Name: "too hot", Kind: RuleTemperatureHigh, Threshold: 28, Quiet: quiet},
+	)
+	night := time.Date(2024, 6, 1, 23, 0, 0, 0, time.Local)
+	hot := int32(31 * protocol.TemperatureScale)
+	level := uint8(10)
+	feeders := []Feeder{{ID: "rabbitf3", Sensors: &protocol.SensorState{Level: &level, Temperature: &hot}}}
+
+	// the critical alert is not held back
+	a.Evaluate(night, feeders)
+	if al := expect(t, sink, AlertFiring); al.Rule != "too hot" || al.Priority != protocol.PriorityCritical {
+		t.Errorf("alert %+v", al)
+	}
+	expect(t, sink, "")
+	if n := len(a.Active()); n != 2 {
+		t.Errorf("%d active alerts, want both", n)
+	}
+
+	a.Evaluate(night.Add(7*time.Hour+59*time.Minute), feeders)
+	expect(t, sink, "")
+	a.Evaluate(night.Add(8*time.Hour), feeders)
+	if al := expect(t, sink, AlertFiring); al.Rule != "hopper low" || !al.Since.Equal(night) {
+		t.Errorf("alert %+v", al)
+	}
+
+	// resolved during the quiet hours before being sent: dropped
+	a, sink = newTestAlerter(t, Rule{Name: "hopper low", Kind: RuleHopperLow, Threshold: 15, Quiet: quiet})
+	a.Evaluate(night, hopperAt(10))
+	a.Evaluate(night.Add(time.Hour), hopperAt(90))
+	a.Evaluate(night.Add(9*time.Hour), hopperAt(90))
+	expect(t, sink, "")
+}
+
+func TestEvaluateDevices(t *testing.T) {
+	a, sink := newTestAlerter(t, Rule{Name: "hopper low", Kind: RuleHopperLow, Threshold: 15, Devices: []string{"rabbitf1"}})
+	a.Evaluate(time.Now(), hopperAt(10))
+	expect(t, sink, "")
+}
+
+func TestAlerterEvent(t *testing.T) {
+	a, sink := newTestAlerter(t, Rule{Name: "feeding failed", Kind: RuleFeedingFailed, For: Duration(15 * time.Minute)})
+	f := Feeder{ID: "rabbitf3", Device: protocol.Device{Name: "Hutch"}}
+	event := func(kind string) protocol.Event {
+		return protocol.Event{ID: f.ID, Message: "Motor jammed",
+			Extra: []protocol.Param{{Name: "event", Type: "string", Value: kind}}}
+	}
+
+	a.Event(f, event("feeding"), time.Now())
+	expect(t, sink, "")
+	a.Event(f, event("feeding_failed"), time.Now())
+	if al := expect(t, sink, AlertFiring); al.Message != "Motor jammed" || al.Name != "Hutch" {
+		t.Errorf("alert %+v", al)
+	}
+	// events have nothing to resolve
+	if n := len(a.Active()); n != 0 {
+		t.Errorf("%d active alerts", n)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// APIPrefix is the root of the version 1 of the HTTP API, described by
+// web/openapi.json. Breaking changes go to a new version.
+const APIPrefix = "/api/v1"
+
+// TokenHeader carries the command token. Every method call needs it, it
+// is forwarded to the device for the methods that check it, e.g. "sm".
+const TokenHeader = "X-Feeder-Token"
+
+// commandToken is the token of the configuration, the method calls are
+// refused without it.
+var commandToken string
+
+const (
+	defaultCallTimeout = 10 * time.Second
+	maxCallTimeout     = time.Minute
+	defaultRange       = 24 * time.Hour
+	maxParamsSize      = 16 << 10
+)
+
+// apiError is the body of every failed API request.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// Telemetry is the answer to a telemetry query, only the series of the
+// requested resolution is set.
+type Telemetry struct {
+	ID         string      `json:"id"`
+	Resolution string      `json:"resolution"`
+	From       time.Time   `json:"from"`
+	To         time.Time   `json:"to"`
+	Samples    []Sample    `json:"samples,omitempty"`
+	Aggregates []Aggregate `json:"aggregates,omitempty"`
+}
+
+// apiHandler serves the API:
+//
+//	GET  /api/v1/devices
+//	GET  /api/v1/devices/{id}
+//	DELETE /api/v1/devices/{id}?purge=true
+//	GET  /api/v1/devices/{id}/descriptor
+//	GET  /api/v1/devices/{id}/telemetry?from=&to=&resolution=raw|hourly
+//	GET  /api/v1/devices/{id}/events?from=&to=&kind=
+//	POST /api/v1/devices/{id}/methods/{method}?timeout=10s
+//	GET  /api/v1/alerts
+//	GET  /api/v1/openapi.json
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "openapi.json":
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		data, err := webFiles.ReadFile("web/openapi.json")
+		if err != nil {
+			apiFail(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	case path == "devices":
+		if allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, hub.List())
+		}
+	case path == "alerts":
+		if allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, alerter.Active())
+		}
+	case len(parts) >= 2 && parts[0] == "devices":
+		f, ok := hub.Get(parts[1])
+		if !ok {
+			apiFail(w, http.StatusNotFound, errors.New("unknown device "+parts[1]))
+			return
+		}
+		deviceAPI(w, r, f, parts[2:])
+	default:
+		apiFail(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func deviceAPI(w http.ResponseWriter, r *http.Request, f Feeder, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodDelete:
+		forgetAPI(w, r, f.ID)
+	case len(parts) == 0:
+		if allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, f)
+		}
+	case len(parts) == 1 && parts[0] == "descriptor":
+		if allow(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, f.Device)
+		}
+	case len(parts) == 1 && parts[0] == "telemetry":
+		if allow(w, r, http.MethodGet) {
+			telemetryAPI(w, r, f.ID)
+		}
+	case len(parts) == 1 && parts[0] == "events":
+		if allow(w, r, http.MethodGet) {
+			eventsAPI(w, r, f.ID)
+		}
+	case len(parts) == 2 && parts[0] == "methods":
+		if allow(w, r, http.MethodPost) {
+			methodAPI(w, r, f, parts[1])
+		}
+	default:
+		apiFail(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// forgetAPI forgets the device, and deletes its stored telemetry with
+// purge=true.
+func forgetAPI(w http.ResponseWriter, r *http.Request, id string) {
+	purge, err := strconv.ParseBool(r.URL.Query().Get("purge"))
+	if err != nil && r.URL.Query().Get("purge") != "" {
+		apiFail(w, http.StatusBadRequest, errors.New("purge must be true or false"))
+		return
+	}
+	if err := forgetDevice(id, purge); err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func telemetryAPI(w http.ResponseWriter, r *http.Request, id string) {
+	from, to, err := timeRange(r)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	t := Telemetry{ID: id, Resolution: r.URL.Query().Get("resolution"), From: from, To: to}
+	switch t.Resolution {
+	case "", SeriesRaw:
+		t.Resolution = SeriesRaw
+		t.Samples, err = store.Samples(id, from, to)
+	case SeriesHourly:
+		t.Aggregates, err = store.Aggregates(id, from, to)
+	default:
+		apiFail(w, http.StatusBadRequest, errors.New("resolution must be raw or hourly"))
+		return
+	}
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func eventsAPI(w http.ResponseWriter, r *http.Request, id string) {
+	from, to, err := timeRange(r)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	events, err := store.Events(id, r.URL.Query().Get("kind"), from, to)
+	if err != nil {
+		apiFail(w, http.StatusInternalServerError, err)
+		return
+	}
+	if events == nil {
+		events = []EventRecord{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// methodAPI calls a method of the device with the params in the body and
+// answers with its response. Device errors are reported with 422, a
+// missing reply with 504.
+//
+// The call needs the token and a JSON body: a form or a page of another
+// site can not send either without a CORS preflight, which is never
+// allowed.
+func methodAPI(w http.ResponseWriter, r *http.Request, f Feeder, name string) {
+	token := r.Header.Get(TokenHeader)
+	switch {
+	case commandToken == "":
+		apiFail(w, http.StatusForbidden, errors.New("method calls are disabled, the dashboard has no token"))
+		return
+	case subtle.ConstantTimeCompare([]byte(token), []byte(commandToken)) != 1:
+		apiFail(w, http.StatusUnauthorized, errors.New("missing or invalid "+TokenHeader))
+		return
+	}
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		apiFail(w, http.StatusUnsupportedMediaType, errors.New("params must be sent as application/json"))
+		return
+	}
+	if len(f.Device.Methods) > 0 && !hasMethod(f.Device, name) {
+		apiFail(w, http.StatusNotFound, errors.New("unknown method "+name))
+		return
+	}
+
+	timeout := defaultCallTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxCallTimeout {
+			apiFail(w, http.StatusBadRequest, errors.New("invalid timeout"))
+			return
+		}
+		timeout = d
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxParamsSize+1))
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(body) > maxParamsSize {
+		apiFail(w, http.StatusRequestEntityTooLarge, errors.New("params too large"))
+		return
+	}
+	var params map[string]json.RawMessage
+	if err := json.Unmarshal(body, &params); err != nil || params == nil {
+		apiFail(w, http.StatusBadRequest, errors.New("params must be a JSON object, {} for none"))
+		return
+	}
+	req := protocol.Request{Method: name, Token: token}
+	if len(params) > 0 {
+		req.Params = body
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	res, err := invoke(ctx, f.ID, req)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		apiFail(w, http.StatusGatewayTimeout, errors.New("no reply from "+f.ID))
+	case err != nil:
+		apiFail(w, http.StatusBadGateway, err)
+	case res.Error != "":
+		writeJSON(w, http.StatusUnprocessableEntity, res)
+	default:
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func hasMethod(d protocol.Device, name string) bool {
+	for _, m := range d.Methods {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// timeRange parses the RFC 3339 from and to parameters, by default the
+// last 24 hours.
+func timeRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	to = time.Now()
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("invalid to, expected RFC 3339")
+		}
+	}
+	from = to.Add(-defaultRange)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("invalid from, expected RFC 3339")
+		}
+	}
+	if from.After(to) {
+		return from, to, errors.New("from is after to")
+	}
+	return from, to, nil
+}
+
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	apiFail(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func apiFail(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
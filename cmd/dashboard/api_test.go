@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// request calls the API and decodes the JSON answer into v, when not nil.
+// The body is sent as JSON, with the token of the test.
+func request(t *testing.T, method, path, body string, v interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(TokenHeader, testToken)
+	return serve(t, r, v)
+}
+
+// serve sends r to the API and decodes the JSON answer into v, when not
+// nil.
+func serve(t *testing.T, r *http.Request, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	apiHandler(w, r)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v: %s", r.Method, r.URL, err, w.Body)
+		}
+	}
+	return w.Code
+}
+
+func TestDevicesAPI(t *testing.T) {
+	_, c := setup(t)
+	discover(t, c, "rabbitf3")
+	temp := int32(21500)
+	hub.Update("rabbitf3", func(f *Feeder) {
+		f.Sensors = &protocol.SensorState{Schema: protocol.SchemaVersion, Temperature: &temp}
+	})
+	hub.Restore("rabbitf1", nil)
+
+	var list []Feeder
+	if code := request(t, http.MethodGet, APIPrefix+"/devices", "", &list); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(list) != 2 || list[0].ID != "rabbitf1" || list[1].ID != "rabbitf3" {
+		t.Fatalf("devices %+v", list)
+	}
+	if list[0].State != StateOffline || list[1].State != StateOnline {
+		t.Errorf("states %s, %s", list[0].State, list[1].State)
+	}
+	if s := list[1].Sensors; s == nil || s.Temperature == nil || *s.Temperature != temp {
+		t.Errorf("sensors %+v", s)
+	}
+
+	var f Feeder
+	if code := request(t, http.MethodGet, APIPrefix+"/devices/rabbitf3", "", &f); code != http.StatusOK || f.ID != "rabbitf3" {
+		t.Errorf("device: %d %+v", code, f)
+	}
+	var e apiError
+	if code := request(t, http.MethodGet, APIPrefix+"/devices/nope", "", &e); code != http.StatusNotFound || e.Error == "" {
+		t.Errorf("unknown device: %d %+v", code, e)
+	}
+	if code := request(t, http.MethodPost, APIPrefix+"/devices", "", &e); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST devices: %d", code)
+	}
+}
+
+func TestDescriptorAPI(t *testing.T) {
+	_, c := setup(t)
+	discover(t, c, "rabbitf3")
+
+	var d protocol.Device
+	if code := request(t, http.MethodGet, APIPrefix+"/devices/rabbitf3/descriptor", "", &d); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if d.Name != testDescriptor.Name || len(d.Methods) != len(testDescriptor.Methods) {
+		t.Errorf("descriptor %+v", d)
+	}
+}
+
+func TestTelemetryAPI(t *testing.T) {
+	setup(t)
+	hub.Restore("rabbitf3", nil)
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		temp := float32(20 + i)
+		// two samples at 10:00 and 10:30, two at 11:00 and 11:30
+		at := day.Add(10*time.Hour + time.Duration(i)*30*time.Minute)
+		if err := store.AddSample("rabbitf3", Sample{Time: at, Temperature: &temp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Maintain(day.Add(36 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	path := APIPrefix + "/devices/rabbitf3/telemetry"
+	var raw Telemetry
+	code := request(t, http.MethodGet, path+"?from=2024-06-01T10:15:00Z&to=2024-06-01T11:00:00Z", "", &raw)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if raw.Resolution != SeriesRaw || len(raw.Samples) != 2 || raw.Aggregates != nil {
+		t.Fatalf("raw telemetry %+v", raw)
+	}
+	if *raw.Samples[0].Temperature != 21 || *raw.Samples[1].Temperature != 22 {
+		t.Errorf("samples %v, %v", *raw.Samples[0].Temperature, *raw.Samples[1].Temperature)
+	}
+
+	var hourly Telemetry
+	code = request(t, http.MethodGet, path+"?from=2024-06-01T00:00:00Z&to=2024-06-02T00:00:00Z&resolution=hourly", "", &hourly)
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if len(hourly.Aggregates) != 2 || hourly.Samples != nil {
+		t.Fatalf("hourly telemetry %+v", hourly)
+	}
+	if a := hourly.Aggregates[1]; a.Count != 2 || a.Temperature.Min != 22 || a.Temperature.Max != 23 || a.Temperature.Avg != 22.5 {
+		t.Errorf("aggregate %+v %+v", a, a.Temperature)
+	}
+
+	for _, query := range []string{
+		"?from=yesterday",
+		"?to=2024-06-01",
+		"?from=2024-06-02T00:00:00Z&to=2024-06-01T00:00:00Z",
+		"?resolution=daily",
+	} {
+		var e apiError
+		if code := request(t, http.MethodGet, path+query, "", &e); code != http.StatusBadRequest || e.Error == "" {
+			t.Errorf("%s: %d %+v", query, code, e)
+		}
+	}
+}
+
+func TestMethodAPI(t *testing.T) {
+	_, c := setup(t)
+	discover(t, c, "rabbitf3")
+	path := APIPrefix + "/devices/rabbitf3/methods/"
+
+	var res protocol.Response
+	if code := request(t, http.MethodPost, path+"food", `{"q": 50}`, &res); code != http.StatusOK {
+		t.Fatalf("food: status %d, %+v", code, res)
+	}
+	if res.Device != "rabbitf3" || res.Method != "food" || res.Result != float64(50) {
+		t.Errorf("food: %+v", res)
+	}
+	c.mu.Lock()
+	var req protocol.Request
+	json.Unmarshal(c.published[len(c.published)-1].payload, &req)
+	c.mu.Unlock()
+	if req.Token != testToken {
+		t.Errorf("token %q not forwarded", req.Token)
+	}
+
+	res = protocol.Response{}
+	if code := request(t, http.MethodPost, path+"food", `{}`, &res); code != http.StatusUnprocessableEntity {
+		t.Errorf("food without quantity: status %d", code)
+	}
+	if res.Error != "invalid params" {
+		t.Errorf("food without quantity: %+v", res)
+	}
+
+	var e apiError
+	if code := request(t, http.MethodPost, path+"sm?timeout=50ms", `{"p": 1, "v": 2}`, &e); code != http.StatusGatewayTimeout {
+		t.Errorf("silent device: status %d, %+v", code, e)
+	}
+
+	tests := []struct {
+		path, body string
+		code       int
+	}{
+		{"reboot", "{}", http.StatusNotFound},
+		{"food", "[50]", http.StatusBadRequest},
+		{"food", "", http.StatusBadRequest},
+		{"food", "null", http.StatusBadRequest},
+		{"food?timeout=2h", `{"q": 50}`, http.StatusBadRequest},
+		{"food?timeout=soon", `{"q": 50}`, http.StatusBadRequest},
+		{"food", `{"q": "` + strings.Repeat("x", maxParamsSize) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		if code := request(t, http.MethodPost, path+tt.path, tt.body, &e); code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.path, code, tt.code)
+		}
+	}
+	if code := request(t, http.MethodGet, path+"food", "", &e); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", code)
+	}
+}
+
+// TestMethodAPIForbidden checks that a call without the token, or that a
+// page of another site could send, never reaches the device.
+func TestMethodAPIForbidden(t *testing.T) {
+	_, c := setup(t)
+	discover(t, c, "rabbitf3")
+	path := APIPrefix + "/devices/rabbitf3/methods/food"
+
+	tests := []struct {
+		name        string
+		token, mime string
+		code        int
+	}{
+		{"no token", "", "application/json", http.StatusUnauthorized},
+		{"wrong token", "guess", "application/json", http.StatusUnauthorized},
+		{"form", testToken, "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"text", testToken, "text/plain", http.StatusUnsupportedMediaType},
+		{"no content type", testToken, "", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"q": 50}`))
+		if tt.mime != "" {
+			r.Header.Set("Content-Type", tt.mime)
+		}
+		if tt.token != "" {
+			r.Header.Set(TokenHeader, tt.token)
+		}
+		var e apiError
+		if code := serve(t, r, &e); code != tt.code || e.Error == "" {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	commandToken = ""
+	var e apiError
+	if code := request(t, http.MethodPost, path, `{"q": 50}`, &e); code != http.StatusForbidden {
+		t.Errorf("without configured token: status %d", code)
+	}
+	if n := c.calls("food"); n != 0 {
+		t.Errorf("%d calls published", n)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var errUnknownBroker = errors.New("no broker known for the device")
+
+// Broker is the connection to one of the configured brokers.
+type Broker struct {
+	BrokerConfig
+	client mqtt.Client
+}
+
+var brokers []*Broker
+
+// connectBroker starts connecting to the broker, retrying until it answers
+// and reconnecting when the connection is lost. Every connection listens to
+// the events, the replies and the discovery, subscribes again to the known
+// devices and asks the feeders to announce themselves.
+func connectBroker(cfg BrokerConfig) (*Broker, error) {
+	b := &Broker{BrokerConfig: cfg}
+	opts := mqtt.NewClientOptions().AddBroker(cfg.URL)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	opts.SetDefaultPublishHandler(defaultHandler)
+	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(b.onConnect)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("broker %s: connection lost: %s\n", cfg.Name, err)
+	})
+	if cfg.TLS != nil {
+		tc, err := cfg.TLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("broker %s: %w", cfg.Name, err)
+		}
+		opts.SetTLSConfig(tc)
+	}
+
+	b.client = mqtt.NewClient(opts)
+	b.client.Connect()
+	return b, nil
+}
+
+func (b *Broker) onConnect(client mqtt.Client) {
+	log.Printf("Connected to broker %s at %s\n", b.Name, b.URL)
+	subs := map[string]mqtt.MessageHandler{
+		protocol.EventsTopic:    eventsHandler,
+		b.replyTopic():          replyHandler,
+		protocol.DiscoveryTopic: b.discoveryHandler,
+	}
+	for topic, handler := range subs {
+		if err := wait(client.Subscribe(topic, 0, handler)); err != nil {
+			log.Printf("broker %s: subscribing to %s: %s\n", b.Name, topic, err)
+		}
+	}
+	registry.Resubscribe(b)
+	if err := wait(client.Publish(protocol.DiscoveryRequestTopic, 0, false, "")); err != nil {
+		log.Printf("broker %s: %s\n", b.Name, err)
+	}
+}
+
+func wait(t mqtt.Token) error {
+	t.Wait()
+	return t.Error()
+}
+
+// replyTopic receives the responses to the calls made by the dashboard.
+func (b *Broker) replyTopic() string {
+	return protocol.ReplyPrefix + "dashboard/" + b.ClientID
+}
+
+func (b *Broker) discoveryHandler(client mqtt.Client, msg mqtt.Message) {
+	log.Printf("[%s]: %s\n", msg.Topic(), msg.Payload())
+	var discovery protocol.Device
+	err := json.Unmarshal(msg.Payload(), &discovery)
+	if err != nil {
+		fmt.Println("Error Unmarshalling DISCOVERY", err)
+		return
+	}
+	if !validID.MatchString(discovery.ID) {
+		log.Printf("[%s]: %s\n", msg.Topic(), errInvalidID)
+		return
+	}
+	hub.Update(discovery.ID, func(f *Feeder) {
+		if f.Device.Name == "" {
+			f.Device.Name = discovery.Name
+		}
+	})
+	registry.Discovered(b, discovery.ID)
+}
+
+// brokerOf returns the broker the device was discovered on, or the only
+// broker when there is one.
+func brokerOf(id string) (*Broker, error) {
+	if b, ok := registry.Broker(id); ok {
+		return b, nil
+	}
+	if len(brokers) == 1 {
+		return brokers[0], nil
+	}
+	return nil, errUnknownBroker
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// DefaultConfigPath is read when it exists and -config is not given.
+const DefaultConfigPath = "dashboard.json"
+
+// Config is the dashboard configuration file, see dashboard.example.json.
+// The environment overrides it, and the flags override the environment.
+type Config struct {
+	HTTP string `json:"http"`
+	Data string `json:"data"`
+	// Token is the command token of the feeders. The method calls of the
+	// API must carry it, they are refused when it is empty.
+	Token     string                  `json:"token,omitempty"`
+	Retention RetentionConfig         `json:"retention"`
+	Brokers   []BrokerConfig          `json:"brokers"`
+	Devices   map[string]DeviceConfig `json:"devices,omitempty"`
+	Alerts    AlertConfig             `json:"alerts"`
+}
+
+// RetentionConfig overrides the DefaultRetention of the series set.
+type RetentionConfig struct {
+	Raw    Duration `json:"raw,omitempty"`
+	Hourly Duration `json:"hourly,omitempty"`
+	Events Duration `json:"events,omitempty"`
+}
+
+// BrokerConfig is an MQTT broker the feeders publish to. The URL scheme is
+// tcp, ssl, ws or wss; TLS only applies to ssl and wss.
+type BrokerConfig struct {
+	Name     string     `json:"name"`
+	URL      string     `json:"url"`
+	Username string     `json:"username,omitempty"`
+	Password string     `json:"password,omitempty"`
+	ClientID string     `json:"client_id,omitempty"`
+	TLS      *TLSConfig `json:"tls,omitempty"`
+}
+
+// TLSConfig holds PEM file paths: CA verifies the broker instead of the
+// system roots, Cert and Key authenticate the dashboard.
+type TLSConfig struct {
+	CA                 string `json:"ca,omitempty"`
+	Cert               string `json:"cert,omitempty"`
+	Key                string `json:"key,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// DeviceConfig is what the installation knows about a feeder.
+type DeviceConfig struct {
+	Name string `json:"name,omitempty"`
+}
+
+// Duration is a time.Duration read from JSON as "10m" or "1h30m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultConfig is used for everything the file and the environment leave
+// unset.
+func DefaultConfig() Config {
+	return Config{
+		HTTP: "localhost:8080",
+		Data: "data",
+	}
+}
+
+// LoadConfig reads the configuration file, a missing file is only an error
+// when required, and applies the environment:
+//
+//	DASHBOARD_HTTP, DASHBOARD_DATA, DASHBOARD_TOKEN
+//	DASHBOARD_MQTT_URL, DASHBOARD_MQTT_USERNAME, DASHBOARD_MQTT_PASSWORD,
+//	DASHBOARD_MQTT_CLIENT_ID  override the first broker, or define it
+func LoadConfig(path string, required bool) (Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
+	case required || !errors.Is(err, os.ErrNotExist):
+		return cfg, err
+	}
+
+	setEnv(&cfg.HTTP, "DASHBOARD_HTTP")
+	setEnv(&cfg.Data, "DASHBOARD_DATA")
+	setEnv(&cfg.Token, "DASHBOARD_TOKEN")
+	var b BrokerConfig
+	if len(cfg.Brokers) > 0 {
+		b = cfg.Brokers[0]
+	}
+	setEnv(&b.URL, "DASHBOARD_MQTT_URL")
+	setEnv(&b.Username, "DASHBOARD_MQTT_USERNAME")
+	setEnv(&b.Password, "DASHBOARD_MQTT_PASSWORD")
+	setEnv(&b.ClientID, "DASHBOARD_MQTT_CLIENT_ID")
+	switch {
+	case len(cfg.Brokers) > 0:
+		cfg.Brokers[0] = b
+	case b != BrokerConfig{}:
+		cfg.Brokers = []BrokerConfig{b}
+	}
+	return cfg, nil
+}
+
+func setEnv(v *string, name string) {
+	if s, ok := os.LookupEnv(name); ok {
+		*v = s
+	}
+}
+
+// Validate checks the whole configuration and fills the default name and
+// client ID of the brokers, the error lists every problem found.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTP); err != nil {
+		fail("http: %q is not host:port", c.HTTP)
+	}
+	if c.Data == "" {
+		fail("data: missing storage directory")
+	}
+	if c.Retention.Raw < 0 || c.Retention.Hourly < 0 || c.Retention.Events < 0 {
+		fail("retention: negative duration")
+	}
+
+	if len(c.Brokers) == 0 {
+		fail("brokers: at least one broker is required, or DASHBOARD_MQTT_URL")
+	}
+	names := make(map[string]bool)
+	clientIDs := make(map[string]bool)
+	for i := range c.Brokers {
+		b := &c.Brokers[i]
+		if b.Name == "" {
+			b.Name = fmt.Sprintf("broker%d", i+1)
+		}
+		if b.ClientID == "" {
+			b.ClientID = "dashboard"
+		}
+		prefix := fmt.Sprintf("brokers[%d] (%s)", i, b.Name)
+		if names[b.Name] {
+			fail("%s: duplicated name", prefix)
+		}
+		names[b.Name] = true
+		if !validID.MatchString(b.ClientID) {
+			fail("%s: client_id must only have letters, digits, - and _", prefix)
+		} else if clientIDs[b.ClientID] {
+			fail("%s: duplicated client_id, it names the reply topic", prefix)
+		}
+		clientIDs[b.ClientID] = true
+
+		u, err := url.Parse(b.URL)
+		if err != nil || u.Host == "" {
+			fail("%s: invalid url %q", prefix, b.URL)
+			continue
+		}
+		switch u.Scheme {
+		case "tcp", "ws":
+			if b.TLS != nil {
+				fail("%s: tls needs an ssl:// or wss:// url", prefix)
+			}
+		case "ssl", "wss":
+			if b.TLS != nil {
+				if _, err := b.TLS.load(); err != nil {
+					fail("%s: tls: %w", prefix, err)
+				}
+			}
+		default:
+			fail("%s: url scheme must be tcp, ssl, ws or wss", prefix)
+		}
+	}
+
+	for id := range c.Devices {
+		if !validID.MatchString(id) {
+			fail("devices: invalid device id %q", id)
+		}
+	}
+	if _, err := NewAlerter(c.Alerts); err != nil {
+		fail("alerts: %w", err)
+	}
+	return errors.Join(errs...)
+}
+
+// StoreRetention is DefaultRetention with the configured overrides.
+func (c *Config) StoreRetention() Retention {
+	r := DefaultRetention
+	if c.Retention.Raw > 0 {
+		r.Raw = time.Duration(c.Retention.Raw)
+	}
+	if c.Retention.Hourly > 0 {
+		r.Hourly = time.Duration(c.Retention.Hourly)
+	}
+	if c.Retention.Events > 0 {
+		r.Events = time.Duration(c.Retention.Events)
+	}
+	return r
+}
+
+// load builds the tls.Config, reading the PEM files.
+func (t *TLSConfig) load() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", t.CA)
+		}
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, errors.New("cert and key go together")
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
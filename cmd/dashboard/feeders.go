@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// maxFeedings is the number of feeding events kept for every feeder.
+const maxFeedings = 50
+
+// Feeder is everything the dashboard knows about a device.
+type Feeder struct {
+	ID string `json:"id"`
+	// Name is the display name from the configuration, the device
+	// announces its own in Device.Name.
+	Name     string                `json:"name,omitempty"`
+	Device   protocol.Device       `json:"device"`
+	Sensors  *protocol.SensorState `json:"sensors,omitempty"`
+	Relays   *protocol.RelayState  `json:"relays,omitempty"`
+	Motor    string                `json:"motor,omitempty"`
+	Schedule []protocol.Alarm      `json:"schedule,omitempty"`
+	// RelaySchedule is nil until the device published it.
+	RelaySchedule *protocol.RelaySchedule `json:"relay_schedule,omitempty"`
+	Feedings      []protocol.Event        `json:"feedings,omitempty"`
+	LastSeen      time.Time               `json:"last_seen"`
+	State         string                  `json:"state"`
+}
+
+func (f *Feeder) clone() Feeder {
+	c := *f
+	c.Device.Out = append([]protocol.Value(nil), f.Device.Out...)
+	c.Device.Methods = append([]protocol.Method(nil), f.Device.Methods...)
+	c.Device.Relays = append([]string(nil), f.Device.Relays...)
+	c.Schedule = append([]protocol.Alarm(nil), f.Schedule...)
+	c.Feedings = append([]protocol.Event(nil), f.Feedings...)
+	if f.Sensors != nil {
+		s := *f.Sensors
+		c.Sensors = &s
+	}
+	if f.Relays != nil {
+		r := *f.Relays
+		c.Relays = &r
+	}
+	if f.RelaySchedule != nil {
+		var s protocol.RelaySchedule
+		for i, events := range f.RelaySchedule {
+			s[i] = append([]protocol.RelayEvent(nil), events...)
+		}
+		c.RelaySchedule = &s
+	}
+	return c
+}
+
+// Hub keeps the state of every feeder and fans out the changes to the
+// listeners, e.g. the web UI.
+type Hub struct {
+	devices map[string]DeviceConfig
+
+	mu        sync.Mutex
+	feeders   map[string]*Feeder
+	listeners map[chan Feeder]struct{}
+}
+
+func NewHub(devices map[string]DeviceConfig) *Hub {
+	return &Hub{
+		devices:   devices,
+		feeders:   make(map[string]*Feeder),
+		listeners: make(map[chan Feeder]struct{}),
+	}
+}
+
+// Update applies fn to the feeder with the given ID, creating it if needed,
+// and notifies the listeners.
+func (h *Hub) Update(id string, fn func(f *Feeder)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, ok := h.feeders[id]
+	if !ok {
+		f = h.newFeeder(id)
+		h.feeders[id] = f
+	}
+	fn(f)
+	f.LastSeen = time.Now()
+	f.State = stateOf(f, f.LastSeen)
+	h.broadcast(f.clone())
+}
+
+func (h *Hub) broadcast(f Feeder) {
+	for l := range h.listeners {
+		select {
+		case l <- f:
+		default:
+			// slow listener, it will catch up with the next update
+		}
+	}
+}
+
+// Refresh updates the state of the feeders from the time they were last
+// seen, and notifies the listeners of the ones that changed.
+func (h *Hub) Refresh(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, f := range h.feeders {
+		if s := stateOf(f, now); s != f.State {
+			f.State = s
+			h.broadcast(f.clone())
+		}
+	}
+}
+
+// Remove forgets the feeder, the listeners receive it in StateForgotten.
+func (h *Hub) Remove(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.feeders[id]; !ok {
+		return
+	}
+	delete(h.feeders, id)
+	h.broadcast(Feeder{ID: id, State: StateForgotten})
+}
+
+// Restore adds a feeder known from the store, with its feeding history,
+// without marking it as seen.
+func (h *Hub) Restore(id string, feedings []protocol.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.feeders[id]; ok {
+		return
+	}
+	f := h.newFeeder(id)
+	for _, ev := range feedings {
+		f.addFeeding(ev)
+	}
+	h.feeders[id] = f
+}
+
+func (h *Hub) newFeeder(id string) *Feeder {
+	return &Feeder{ID: id, Name: h.devices[id].Name, Device: protocol.Device{ID: id}, State: StateOffline}
+}
+
+// Get returns a copy of the feeder.
+func (h *Hub) Get(id string) (Feeder, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, ok := h.feeders[id]
+	if !ok {
+		return Feeder{}, false
+	}
+	return f.clone(), true
+}
+
+// List returns a copy of every feeder, sorted by ID.
+func (h *Hub) List() []Feeder {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]Feeder, 0, len(h.feeders))
+	for _, f := range h.feeders {
+		list = append(list, f.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Listen returns a channel receiving every updated feeder, and the function
+// to call when done with it.
+func (h *Hub) Listen() (<-chan Feeder, func()) {
+	l := make(chan Feeder, 16)
+	h.mu.Lock()
+	h.listeners[l] = struct{}{}
+	h.mu.Unlock()
+	return l, func() {
+		h.mu.Lock()
+		delete(h.listeners, l)
+		h.mu.Unlock()
+	}
+}
+
+// addFeeding records a feeding event, keeping the newest maxFeedings.
+func (f *Feeder) addFeeding(ev protocol.Event) {
+	f.Feedings = append(f.Feedings, ev)
+	if len(f.Feedings) > maxFeedings {
+		f.Feedings = append([]protocol.Event(nil), f.Feedings[len(f.Feedings)-maxFeedings:]...)
+	}
+}
@@ -1,94 +1,107 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"flag"
 	"log"
-	"os"
+	"net/http"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/conejoninja/rabbit-feeder/protocol"
 )
 
-var subscriptions map[string]bool
-var token mqtt.Token
-var c mqtt.Client
+var hub *Hub
+var store *Store
+var alerter *Alerter
+var registry *Registry
 
-func main() {
-
-	subscriptions = make(map[string]bool)
+var (
+	configPath = flag.String("config", "", "JSON configuration file, "+DefaultConfigPath+" when it exists")
+	httpAddr   = flag.String("http", "", "address of the web UI, overrides the configuration")
+	dataDir    = flag.String("data", "", "directory where the telemetry is stored, overrides the configuration")
+)
 
-	opts := mqtt.NewClientOptions().AddBroker(MQTTProtocol + "://" + MQTTServer + ":" + MQTTPort)
-	opts.SetClientID(MQTTClientID)
-	opts.SetUsername(MQTTUser)
-	opts.SetPassword(MQTTPassword)
-	opts.SetDefaultPublishHandler(defaultHandler)
+func main() {
+	flag.Parse()
 
-	c = mqtt.NewClient(opts)
-	if token = c.Connect(); token.Wait() && token.Error() != nil {
-		log.Println(token)
-		log.Println(token.Error())
-		panic(token.Error())
+	path, required := *configPath, true
+	if path == "" {
+		path, required = DefaultConfigPath, false
 	}
-	defer c.Disconnect(250)
-
-	// Discover new devices when they connect to the network
-	if token = c.Subscribe("discovery", 0, discoveryHandler); token.Wait() && token.Error() != nil {
-		fmt.Println(token.Error())
-		os.Exit(1)
+	cfg, err := LoadConfig(path, required)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *httpAddr != "" {
+		cfg.HTTP = *httpAddr
+	}
+	if *dataDir != "" {
+		cfg.Data = *dataDir
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid configuration:\n%s", err)
 	}
 
-	/*
-		if token = c.Subscribe("events", 0, eventsHandler); token.Wait() && token.Error() != nil {
-			fmt.Println(token.Error())
-			os.Exit(1)
-		}*/
+	commandToken = cfg.Token
+	if commandToken == "" {
+		log.Println("no token configured, the method calls are disabled")
+	}
 
-	for {
+	hub = NewHub(cfg.Devices)
+	if store, err = NewStore(cfg.Data, cfg.StoreRetention()); err != nil {
+		log.Fatal(err)
 	}
-}
+	restoreFeeders()
+	go maintainStore()
 
-/*
-var discoveryHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("DISCOVERY: %s\n", msg.Payload())
-	var device common.Device
-	err := json.Unmarshal(msg.Payload(), &device)
-	if err == nil {
-		//db.AddDevice([]byte(device.ID), device)
-		if v, ok := subscriptions[device.ID]; !ok || !v {
-			subscriptions[device.ID] = true
-			if token = c.Subscribe(device.ID, 0, nil); token.Wait() && token.Error() != nil {
-				subscriptions[device.ID] = false
-				log.Println(token.Error())
-				os.Exit(1)
-			}
+	if alerter, err = NewAlerter(cfg.Alerts); err != nil {
+		log.Fatal(err)
+	}
+	go alerter.Run(hub)
 
+	registry = NewRegistry()
+	for _, bc := range cfg.Brokers {
+		b, err := connectBroker(bc)
+		if err != nil {
+			log.Fatal(err)
 		}
-	} else {
-		log.Println(err)
+		defer b.client.Disconnect(250)
+		brokers = append(brokers, b)
 	}
-}
-*/
+	go watchDevices()
 
-var defaultHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("[%s]: %s\n", msg.Topic(), msg.Payload())
+	log.Println("Web UI listening on", cfg.HTTP)
+	log.Fatal(http.ListenAndServe(cfg.HTTP, newWebHandler()))
 }
 
-var discoveryHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("[%s]: %s\n", msg.Topic(), msg.Payload())
-	var discovery Device
-	err := json.Unmarshal(msg.Payload(), &discovery)
+// restoreFeeders fills the hub with the feeding history of the devices
+// found in the store.
+func restoreFeeders() {
+	ids, err := store.Devices()
 	if err != nil {
-		fmt.Println("Error Unmarshalling DISCOVERY", err)
+		log.Println(err)
 		return
 	}
-
-	if v, ok := subscriptions[discovery.ID]; !ok || !v {
-		subscriptions[discovery.ID] = true
-		if token = c.Subscribe(discovery.ID, 0, nil); token.Wait() && token.Error() != nil {
-			subscriptions[discovery.ID] = false
-			log.Println(token.Error())
-			os.Exit(1)
+	now := time.Now()
+	for _, id := range ids {
+		records, err := store.Events(id, "feeding", now.Add(-30*24*time.Hour), now)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
+		feedings := make([]protocol.Event, len(records))
+		for i, r := range records {
+			feedings[i] = r.Event
+		}
+		hub.Restore(id, feedings)
+	}
+}
 
+// maintainStore downsamples and expires the stored telemetry every hour.
+func maintainStore() {
+	for {
+		if err := store.Maintain(time.Now()); err != nil {
+			log.Println("store maintenance:", err)
+		}
+		time.Sleep(time.Hour)
 	}
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var callID uint64
+
+var defaultHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	log.Printf("[%s]: %s\n", msg.Topic(), msg.Payload())
+}
+
+// deviceHandler updates the hub with the messages published by a device on
+// its own topics.
+var deviceHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	parts := strings.SplitN(msg.Topic(), "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+	id, payload := parts[0], msg.Payload()
+	if _, ok := registry.Broker(id); !ok {
+		// forgotten, the message was in flight when unsubscribing
+		return
+	}
+	if command(id, msg.Topic()) {
+		return
+	}
+
+	var err error
+	switch msg.Topic() {
+	case protocol.DeviceTopic(id):
+		var d protocol.Device
+		if err = json.Unmarshal(payload, &d); err == nil {
+			hub.Update(id, func(f *Feeder) { f.Device = d })
+		}
+	case protocol.SensorStateTopic(id):
+		var s protocol.SensorState
+		if s, err = protocol.DecodeSensorState(payload); err == nil {
+			hub.Update(id, func(f *Feeder) { f.Sensors = &s })
+			err = store.AddSample(id, sampleFromState(time.Now(), &s))
+		}
+	case protocol.RelayStateTopic(id):
+		var r protocol.RelayState
+		if err = json.Unmarshal(payload, &r); err == nil {
+			hub.Update(id, func(f *Feeder) { f.Relays = &r })
+		}
+	case protocol.MotorStateTopic(id):
+		hub.Update(id, func(f *Feeder) { f.Motor = string(payload) })
+	case protocol.ScheduleTopic(id):
+		var s []protocol.Alarm
+		if err = json.Unmarshal(payload, &s); err == nil {
+			hub.Update(id, func(f *Feeder) { f.Schedule = s })
+		}
+	case protocol.RelayScheduleTopic(id):
+		var s protocol.RelaySchedule
+		if err = json.Unmarshal(payload, &s); err == nil {
+			hub.Update(id, func(f *Feeder) { f.RelaySchedule = &s })
+		}
+	default:
+		defaultHandler(client, msg)
+	}
+	if err != nil {
+		log.Printf("[%s]: %s\n", msg.Topic(), err)
+	}
+}
+
+// command tells whether topic receives the commands sent to the device
+// rather than its messages: the calls and the "/set" and "/get" topics.
+// They may carry the command token, so they are never logged.
+func command(id, topic string) bool {
+	return topic == protocol.CallTopic(id) || strings.HasSuffix(topic, "/set") || strings.HasSuffix(topic, "/get")
+}
+
+var eventsHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	var ev protocol.Event
+	if err := json.Unmarshal(msg.Payload(), &ev); err != nil {
+		log.Printf("[%s]: %s\n", msg.Topic(), err)
+		return
+	}
+	if _, ok := registry.Broker(ev.ID); !ok {
+		// not discovered, or forgotten
+		return
+	}
+	log.Printf("EVENT %s: %s %s\n", ev.ID, ev.Kind(), ev.Message)
+	if err := store.AddEvent(ev.ID, EventRecord{Time: time.Now(), Event: ev}); err != nil {
+		log.Println(err)
+	}
+	if ev.Kind() == "feeding" {
+		hub.Update(ev.ID, func(f *Feeder) { f.addFeeding(ev) })
+	}
+	f, ok := hub.Get(ev.ID)
+	if !ok {
+		f = Feeder{ID: ev.ID}
+	}
+	alerter.Event(f, ev, time.Now())
+}
+
+// pending holds the calls waiting for their response, by request ID.
+var pending = struct {
+	sync.Mutex
+	calls map[string]chan protocol.Response
+}{calls: make(map[string]chan protocol.Response)}
+
+var replyHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	var result json.RawMessage
+	res, err := protocol.DecodeResponse(msg.Payload(), &result)
+	if err != nil {
+		log.Printf("[%s]: %s\n", msg.Topic(), err)
+		return
+	}
+	if len(result) > 0 {
+		res.Result = result
+	} else {
+		res.Result = nil
+	}
+	if res.Error != "" {
+		log.Printf("CALL %s %s.%s failed: %s\n", res.ID, res.Device, res.Method, res.Error)
+	}
+
+	pending.Lock()
+	ch, ok := pending.calls[res.ID]
+	delete(pending.calls, res.ID)
+	pending.Unlock()
+	if ok {
+		ch <- res
+	}
+}
+
+// invoke publishes a method call for the device and waits for its response,
+// whose Result is left as raw JSON.
+func invoke(ctx context.Context, id string, req protocol.Request) (protocol.Response, error) {
+	req.ID = nextCallID()
+	ch := make(chan protocol.Response, 1)
+	pending.Lock()
+	pending.calls[req.ID] = ch
+	pending.Unlock()
+	defer func() {
+		pending.Lock()
+		delete(pending.calls, req.ID)
+		pending.Unlock()
+	}()
+
+	if err := publishRequest(id, &req); err != nil {
+		return protocol.Response{}, err
+	}
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-ctx.Done():
+		return protocol.Response{}, ctx.Err()
+	}
+}
+
+func nextCallID() string {
+	return strconv.FormatUint(atomic.AddUint64(&callID, 1), 10)
+}
+
+func publishRequest(id string, req *protocol.Request) error {
+	b, err := brokerOf(id)
+	if err != nil {
+		return err
+	}
+	req.Reply = b.replyTopic()
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return wait(b.client.Publish(protocol.CallTopic(id), 0, false, data))
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is a completed mqtt.Token.
+type fakeToken struct{ err error }
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Error() error                   { return t.err }
+
+func (t fakeToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// fakeClient stands in for the connection to a broker. The messages
+// published by the dashboard go to device, the messages sent with deliver
+// go to the matching subscriptions.
+type fakeClient struct {
+	mu     sync.Mutex
+	closed bool
+	// subErr fails the subscriptions to the devices.
+	subErr    error
+	subs      map[string]mqtt.MessageHandler
+	unsubs    []string
+	published []fakeMessage
+	device    func(c *fakeClient, msg fakeMessage)
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{subs: make(map[string]mqtt.MessageHandler)}
+}
+
+func (c *fakeClient) IsConnected() bool { return c.IsConnectionOpen() }
+
+func (c *fakeClient) IsConnectionOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed
+}
+
+func (c *fakeClient) Connect() mqtt.Token { return fakeToken{} }
+func (c *fakeClient) Disconnect(uint)     {}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	}
+	msg := fakeMessage{topic: topic, payload: data}
+	c.mu.Lock()
+	c.published = append(c.published, msg)
+	device := c.device
+	c.mu.Unlock()
+	if device != nil {
+		go device(c, msg)
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subErr != nil && strings.HasSuffix(topic, "/#") {
+		return fakeToken{c.subErr}
+	}
+	c.subs[topic] = callback
+	if strings.HasSuffix(topic, "/#") {
+		descriptions.asked()
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic, qos := range filters {
+		c.Subscribe(topic, qos, callback)
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topic := range topics {
+		delete(c.subs, topic)
+		c.unsubs = append(c.unsubs, topic)
+	}
+	return fakeToken{}
+}
+
+func (c *fakeClient) AddRoute(string, mqtt.MessageHandler) {}
+
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// subscribed tells whether the client is subscribed to topic.
+func (c *fakeClient) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.subs[topic]
+	return ok
+}
+
+// deliver sends a message to the handlers of the matching subscriptions,
+// as the broker would.
+func (c *fakeClient) deliver(topic string, payload []byte) {
+	c.mu.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, h := range c.subs {
+		if topicMatches(filter, topic) {
+			handlers = append(handlers, h)
+		}
+	}
+	c.mu.Unlock()
+	for _, h := range handlers {
+		h(c, fakeMessage{topic: topic, payload: payload})
+	}
+}
+
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i := range f {
+		switch {
+		case f[i] == "#":
+			return true
+		case i >= len(t):
+			return false
+		case f[i] != "+" && f[i] != t[i]:
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+var testDescriptor = protocol.Device{
+	ID:   "rabbitf3",
+	Name: "Rabbit feeder",
+	Methods: []protocol.Method{
+		{Name: "info"},
+		{Name: "food", Params: []protocol.Value{{ID: "q", Name: "Quantity", Unit: "g"}}},
+		{Name: "sm"},
+	},
+}
+
+// descriptionTracker follows the descriptors the dashboard asks for
+// after every subscription to a device, with describe. Each answer gets
+// its own Version, so the test knows when the hub received the last one.
+type descriptionTracker struct {
+	sync.Mutex
+	pending  int
+	sent     int
+	versions map[string]string
+}
+
+var descriptions descriptionTracker
+
+func (d *descriptionTracker) reset() {
+	d.Lock()
+	defer d.Unlock()
+	d.pending, d.sent, d.versions = 0, 0, make(map[string]string)
+}
+
+func (d *descriptionTracker) asked() {
+	d.Lock()
+	defer d.Unlock()
+	d.pending++
+}
+
+// answer returns the descriptor sent to the dashboard for id.
+func (d *descriptionTracker) answer(id string) protocol.Device {
+	d.Lock()
+	defer d.Unlock()
+	d.pending--
+	d.sent++
+	desc := testDescriptor
+	desc.Version = "test-" + strconv.Itoa(d.sent)
+	d.versions[id] = desc.Version
+	return desc
+}
+
+// settled tells whether the hub holds the last descriptor sent for every
+// device, the goroutines of describe are then done with the globals.
+func (d *descriptionTracker) settled() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.pending > 0 {
+		return false
+	}
+	for id, v := range d.versions {
+		if f, ok := hub.Get(id); !ok || f.Device.Version != v {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeDevice answers the calls like the firmware: info returns
+// testDescriptor, food returns its quantity or fails without one, and sm
+// never answers.
+func fakeDevice(c *fakeClient, msg fakeMessage) {
+	if !strings.HasSuffix(msg.topic, "/call") {
+		return
+	}
+	var req protocol.Request
+	if err := json.Unmarshal(msg.payload, &req); err != nil {
+		return
+	}
+	res := protocol.Response{ID: req.ID, Device: strings.TrimSuffix(msg.topic, "/call"), Method: req.Method}
+	switch req.Method {
+	case "info":
+		res.Result = descriptions.answer(res.Device)
+	case "food":
+		var p struct {
+			Q uint32 `json:"q"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if p.Q == 0 {
+			res.Error = "invalid params"
+		} else {
+			res.Result = p.Q
+		}
+	case "sm":
+		return
+	default:
+		res.Error = "unknown method"
+	}
+	data, _ := json.Marshal(res)
+	c.deliver(req.Reply, data)
+}
+
+// testToken is the command token of the dashboard in the tests.
+const testToken = "s3cret"
+
+// setup replaces the globals of the dashboard with a fresh hub, store,
+// registry and alerter, and one connected broker using a fakeClient.
+func setup(t *testing.T) (*Broker, *fakeClient) {
+	t.Helper()
+	descriptions.reset()
+	commandToken = testToken
+	var err error
+	hub = NewHub(nil)
+	if store, err = NewStore(t.TempDir(), DefaultRetention); err != nil {
+		t.Fatal(err)
+	}
+	if alerter, err = NewAlerter(AlertConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	registry = NewRegistry()
+	c := newFakeClient()
+	c.device = fakeDevice
+	b := &Broker{BrokerConfig: BrokerConfig{Name: "test", ClientID: "test"}, client: c}
+	brokers = []*Broker{b}
+	b.onConnect(c)
+	t.Cleanup(func() {
+		// the next test replaces the globals describe uses
+		eventually(t, "the descriptors", descriptions.settled)
+	})
+	return b, c
+}
+
+// eventually fails the test unless cond becomes true within a second.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+	}
+}
+
+// discover announces the device on the broker and waits until the
+// dashboard described it.
+func discover(t *testing.T, c *fakeClient, id string) {
+	t.Helper()
+	d, _ := json.Marshal(protocol.Device{ID: id, Name: "Rabbit feeder"})
+	c.deliver(protocol.DiscoveryTopic, d)
+	eventually(t, "the descriptor of "+id, func() bool {
+		f, ok := hub.Get(id)
+		return ok && len(f.Device.Methods) > 0
+	})
+}
+
+// TestDeviceHandlerCommands checks that the commands sent to a device,
+// which carry the token, are not logged while the other messages are.
+func TestDeviceHandlerCommands(t *testing.T) {
+	_, c := setup(t)
+	discover(t, c, "rabbitf3")
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	call, _ := json.Marshal(protocol.Request{ID: "1", Method: "sm", Token: testToken})
+	c.deliver(protocol.CallTopic("rabbitf3"), call)
+	c.deliver(protocol.EEPROMTopic("rabbitf3")+"/set", []byte(`{"token":"`+testToken+`","p":50,"v":1}`))
+	c.deliver(protocol.ConfigTopic("rabbitf3")+"/set", []byte(`{"token":"`+testToken+`"}`))
+	if strings.Contains(buf.String(), testToken) {
+		t.Errorf("token logged:\n%s", buf.String())
+	}
+	c.deliver(protocol.I2CTopic("rabbitf3"), []byte(`{"recoveries":1}`))
+	if !strings.Contains(buf.String(), "recoveries") {
+		t.Errorf("device message not logged:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// Sink delivers alerts to humans.
+type Sink interface {
+	Notify(a Alert) error
+}
+
+// Types of sinks.
+const (
+	SinkSMTP    = "smtp"
+	SinkWebhook = "webhook"
+	SinkNtfy    = "ntfy"
+)
+
+// notifyTimeout bounds every HTTP notification.
+const notifyTimeout = 10 * time.Second
+
+var errInvalidSink = errors.New("invalid sink")
+
+// SinkConfig configures a sink, the fields used depend on its type:
+//
+//	smtp     Addr (host:port), From, To, Username, Password
+//	webhook  URL, Headers; the Alert is POSTed as JSON
+//	ntfy     URL (server and topic), Token
+type SinkConfig struct {
+	Type     string            `json:"type"`
+	Addr     string            `json:"addr,omitempty"`
+	From     string            `json:"from,omitempty"`
+	To       []string          `json:"to,omitempty"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Token    string            `json:"token,omitempty"`
+}
+
+func NewSink(c SinkConfig) (Sink, error) {
+	switch c.Type {
+	case SinkSMTP:
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return nil, fmt.Errorf("%w: addr must be host:port", errInvalidSink)
+		}
+		if c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("%w: from and to are required", errInvalidSink)
+		}
+		return &SMTPSink{Addr: c.Addr, From: c.From, To: c.To, Username: c.Username, Password: c.Password}, nil
+	case SinkWebhook, SinkNtfy:
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return nil, fmt.Errorf("%w: url must be http or https", errInvalidSink)
+		}
+		client := &http.Client{Timeout: notifyTimeout}
+		if c.Type == SinkNtfy {
+			return &NtfySink{URL: c.URL, Token: c.Token, Client: client}, nil
+		}
+		return &WebhookSink{URL: c.URL, Headers: c.Headers, Client: client}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown type %q", errInvalidSink, c.Type)
+}
+
+// title is the one line summary of an alert.
+func (a Alert) title() string {
+	name := a.Name
+	if name == "" {
+		name = a.Device
+	}
+	if a.State == AlertResolved {
+		return "[" + name + "] resolved: " + a.Rule
+	}
+	return "[" + name + "] " + a.Rule
+}
+
+// SMTPSink mails the alerts, authenticating with PLAIN when Username is set.
+type SMTPSink struct {
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+func (s *SMTPSink) Notify(a Alert) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", a.title())
+	fmt.Fprintf(&msg, "Date: %s\r\n", a.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nDevice: %s\r\nSince: %s\r\n", a.Message, a.Device, a.Since.Format(time.RFC3339))
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, msg.Bytes())
+}
+
+// WebhookSink POSTs the alerts as JSON.
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+func (s *WebhookSink) Notify(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	return do(s.Client, req)
+}
+
+// NtfySink publishes the alerts to an ntfy topic: the message as body,
+// title, priority and tags as headers.
+type NtfySink struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (s *NtfySink) Notify(a Alert) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, strings.NewReader(a.Message))
+	if err != nil {
+		return err
+	}
+	priority, tag := "default", "warning"
+	switch {
+	case a.State == AlertResolved:
+		priority, tag = "low", "white_check_mark"
+	case a.Priority >= protocol.PriorityCritical:
+		priority, tag = "urgent", "rotating_light"
+	case a.Priority >= protocol.PriorityWarning:
+		priority = "high"
+	}
+	req.Header.Set("Title", a.title())
+	req.Header.Set("Priority", priority)
+	req.Header.Set("Tags", tag)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	return do(s.Client, req)
+}
+
+func do(client *http.Client, req *http.Request) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", req.URL.Redacted(), res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+var testAlert = Alert{
+	Rule:     "hopper low",
+	Kind:     RuleHopperLow,
+	Device:   "rabbitf3",
+	Name:     "Hutch",
+	State:    AlertFiring,
+	Message:  "hopper at 10%",
+	Priority: protocol.PriorityWarning,
+	Since:    time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC),
+	Time:     time.Date(2024, 6, 1, 8, 30, 0, 0, time.UTC),
+}
+
+func TestNewSink(t *testing.T) {
+	for _, c := range []SinkConfig{
+		{Type: "pager"},
+		{Type: SinkSMTP, Addr: "mail.example.com", From: "a@example.com", To: []string{"b@example.com"}},
+		{Type: SinkSMTP, Addr: "mail.example.com:25", From: "a@example.com"},
+		{Type: SinkWebhook, URL: "ftp://example.com/hook"},
+		{Type: SinkNtfy},
+	} {
+		if _, err := NewSink(c); err == nil {
+			t.Errorf("NewSink(%+v) succeeded", c)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got Alert
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewSink(SinkConfig{Type: SinkWebhook, URL: srv.URL, Headers: map[string]string{"X-Secret": "s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Notify(testAlert); err != nil {
+		t.Fatal(err)
+	}
+	if got != testAlert {
+		t.Errorf("got %+v, want %+v", got, testAlert)
+	}
+	if header.Get("Content-Type") != "application/json" || header.Get("X-Secret") != "s3cret" {
+		t.Errorf("headers %v", header)
+	}
+}
+
+func TestWebhookSinkStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	s, _ := NewSink(SinkConfig{Type: SinkWebhook, URL: srv.URL})
+	if err := s.Notify(testAlert); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want the status", err)
+	}
+}
+
+func TestNtfySink(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   string
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Header, string(body)}
+	}))
+	defer srv.Close()
+	s, err := NewSink(SinkConfig{Type: SinkNtfy, URL: srv.URL + "/rabbits", Token: "tk_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	critical := testAlert
+	critical.Priority = protocol.PriorityCritical
+	resolved := testAlert
+	resolved.State, resolved.Message = AlertResolved, "resolved: hopper at 10%"
+	tests := []struct {
+		alert    Alert
+		title    string
+		priority string
+		tags     string
+	}{
+		{testAlert, "[Hutch] hopper low", "high", "warning"},
+		{critical, "[Hutch] hopper low", "urgent", "rotating_light"},
+		{resolved, "[Hutch] resolved: hopper low", "low", "white_check_mark"},
+	}
+	for _, tt := range tests {
+		if err := s.Notify(tt.alert); err != nil {
+			t.Fatal(err)
+		}
+		r := <-requests
+		if r.body != tt.alert.Message {
+			t.Errorf("body %q, want %q", r.body, tt.alert.Message)
+		}
+		if h := r.header; h.Get("Title") != tt.title || h.Get("Priority") != tt.priority || h.Get("Tags") != tt.tags {
+			t.Errorf("%s: headers %v", tt.title, h)
+		}
+		if r.header.Get("Authorization") != "Bearer tk_1" {
+			t.Errorf("authorization %q", r.header.Get("Authorization"))
+		}
+	}
+}
+
+// smtpSession is what the fake SMTP server received.
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// smtpServer accepts one SMTP session, advertising AUTH PLAIN, and sends
+// what it received on the returned channel.
+func smtpServer(t *testing.T) (string, <-chan smtpSession) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var s smtpSession
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case cmd == "EHLO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case cmd == "AUTH":
+				s.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+				reply("235 ok")
+			case strings.HasPrefix(line, "MAIL FROM:"):
+				s.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+				reply("250 ok")
+			case strings.HasPrefix(line, "RCPT TO:"):
+				s.to = append(s.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+				reply("250 ok")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				s.data = data.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				sessions <- s
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	}()
+	return l.Addr().String(), sessions
+}
+
+func TestSMTPSink(t *testing.T) {
+	addr, sessions := smtpServer(t)
+	s, err := NewSink(SinkConfig{
+		Type:     SinkSMTP,
+		Addr:     addr,
+		From:     "feeder@example.com",
+		To:       []string{"me@example.com", "vet@example.com"},
+		Username: "feeder",
+		Password: "hunter2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Notify(testAlert); err != nil {
+		t.Fatal(err)
+	}
+
+	var got smtpSession
+	select {
+	case got = <-sessions:
+	case <-time.After(time.Second):
+		t.Fatal("no SMTP session")
+	}
+	if auth, _ := base64.StdEncoding.DecodeString(got.auth); string(auth) != "\x00feeder\x00hunter2" {
+		t.Errorf("auth %q", auth)
+	}
+	if got.from != "feeder@example.com" || strings.Join(got.to, ",") != "me@example.com,vet@example.com" {
+		t.Errorf("envelope %s -> %v", got.from, got.to)
+	}
+	for _, want := range []string{
+		"Subject: [Hutch] hopper low\r\n",
+		"To: me@example.com, vet@example.com\r\n",
+		"\r\n\r\nhopper at 10%\r\n",
+		"Device: rabbitf3\r\n",
+	} {
+		if !strings.Contains(got.data, want) {
+			t.Errorf("message misses %q:\n%s", want, got.data)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// Device states, from the time the device was last heard of.
+const (
+	// StateDiscovered is a device that announced itself but sent no
+	// telemetry yet.
+	StateDiscovered = "discovered"
+	StateOnline     = "online"
+	// StateStale is a device that missed a few sensor publications, the
+	// firmware sends them every minute.
+	StateStale = "stale"
+	// StateOffline is a device silent for offlineAfter, or only known from
+	// the store.
+	StateOffline = "offline"
+	// StateForgotten is only sent to the listeners of the hub, when an
+	// operator forgets a device.
+	StateForgotten = "forgotten"
+)
+
+const (
+	staleAfter   = 3 * time.Minute
+	offlineAfter = 10 * time.Minute
+	// watchInterval is how often the states are refreshed and the failed
+	// subscriptions retried.
+	watchInterval = 15 * time.Second
+)
+
+var errUnknownDevice = errors.New("unknown device")
+
+// stateOf returns the state of the feeder at now.
+func stateOf(f *Feeder, now time.Time) string {
+	silent := now.Sub(f.LastSeen)
+	switch {
+	case f.LastSeen.IsZero(), silent >= offlineAfter:
+		return StateOffline
+	case silent >= staleAfter:
+		return StateStale
+	case f.Sensors == nil:
+		return StateDiscovered
+	}
+	return StateOnline
+}
+
+// Registry is the broker every discovered device was found on, and whether
+// the dashboard is subscribed to its topics there.
+type Registry struct {
+	mu      sync.Mutex
+	devices map[string]*registration
+}
+
+type registration struct {
+	broker     *Broker
+	subscribed bool
+	pending    bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{devices: make(map[string]*registration)}
+}
+
+// Discovered records the device announced on the broker and subscribes to
+// its topics, moving it when it was known on another broker. It does not
+// block, the MQTT handlers must not wait for the broker.
+func (r *Registry) Discovered(b *Broker, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.devices[id]
+	if ok && reg.broker == b && (reg.subscribed || reg.pending) {
+		return
+	}
+	if ok && reg.broker != b {
+		log.Printf("Device %s moved from broker %s to %s\n", id, reg.broker.Name, b.Name)
+		go reg.broker.client.Unsubscribe(protocol.DeviceSubscription(id))
+	}
+	r.devices[id] = &registration{broker: b, pending: true}
+	go r.subscribe(b, id)
+}
+
+func (r *Registry) subscribe(b *Broker, id string) {
+	err := wait(b.client.Subscribe(protocol.DeviceSubscription(id), 0, deviceHandler))
+	if err != nil {
+		log.Printf("broker %s: subscribing to %s: %s\n", b.Name, id, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.devices[id]
+	if !ok || reg.broker != b {
+		return
+	}
+	reg.pending = false
+	reg.subscribed = err == nil
+	if reg.subscribed {
+		go describe(id)
+	}
+}
+
+// describe asks the device for its full descriptor, published before the
+// dashboard subscribed to its topics.
+func describe(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCallTimeout)
+	defer cancel()
+	res, err := invoke(ctx, id, protocol.Request{Method: "info"})
+	if err == nil && res.Error != "" {
+		err = errors.New(res.Error)
+	}
+	var d protocol.Device
+	if err == nil {
+		raw, _ := res.Result.(json.RawMessage)
+		err = json.Unmarshal(raw, &d)
+	}
+	if err != nil {
+		log.Printf("Describing %s: %s\n", id, err)
+		return
+	}
+	hub.Update(id, func(f *Feeder) { f.Device = d })
+}
+
+// Resubscribe subscribes again to the devices of the broker, after it
+// reconnected with a clean session.
+func (r *Registry) Resubscribe(b *Broker) {
+	r.mu.Lock()
+	var ids []string
+	for id, reg := range r.devices {
+		if reg.broker == b {
+			reg.subscribed, reg.pending = false, true
+			ids = append(ids, id)
+		}
+	}
+	r.mu.Unlock()
+	for _, id := range ids {
+		r.subscribe(b, id)
+	}
+}
+
+// Retry subscribes again to the devices whose subscription failed, on the
+// brokers currently connected.
+func (r *Registry) Retry() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, reg := range r.devices {
+		if !reg.subscribed && !reg.pending && reg.broker.client.IsConnectionOpen() {
+			reg.pending = true
+			go r.subscribe(reg.broker, id)
+		}
+	}
+}
+
+// Broker returns the broker the device was discovered on.
+func (r *Registry) Broker(id string) (*Broker, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.devices[id]
+	if !ok {
+		return nil, false
+	}
+	return reg.broker, true
+}
+
+// Forget unsubscribes from the device. It comes back if it announces itself
+// again.
+func (r *Registry) Forget(id string) error {
+	r.mu.Lock()
+	reg, ok := r.devices[id]
+	delete(r.devices, id)
+	r.mu.Unlock()
+	if !ok {
+		return errUnknownDevice
+	}
+	return wait(reg.broker.client.Unsubscribe(protocol.DeviceSubscription(id)))
+}
+
+// watchDevices refreshes the states of the devices and retries the failed
+// subscriptions until the process exits.
+func watchDevices() {
+	for {
+		time.Sleep(watchInterval)
+		hub.Refresh(time.Now())
+		registry.Retry()
+	}
+}
+
+// forgetDevice removes a device from the dashboard, and its stored
+// telemetry when purge is set.
+func forgetDevice(id string, purge bool) error {
+	if err := registry.Forget(id); err != nil && !errors.Is(err, errUnknownDevice) {
+		return err
+	}
+	hub.Remove(id)
+	alerter.Forget(id)
+	if purge {
+		return store.Remove(id)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// subscription returns the state of the subscription to the device.
+func subscription(id string) (subscribed, pending bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if reg, ok := registry.devices[id]; ok {
+		return reg.subscribed, reg.pending
+	}
+	return false, false
+}
+
+// calls counts the calls of method published on the client.
+func (c *fakeClient) calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, msg := range c.published {
+		var req protocol.Request
+		if json.Unmarshal(msg.payload, &req) == nil && req.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRegistryDiscovered(t *testing.T) {
+	b, c := setup(t)
+	if !c.subscribed(protocol.EventsTopic) || !c.subscribed(protocol.DiscoveryTopic) || !c.subscribed(b.replyTopic()) {
+		t.Fatalf("subscriptions %v", c.subs)
+	}
+	discover(t, c, "rabbitf3")
+	if !c.subscribed(protocol.DeviceSubscription("rabbitf3")) {
+		t.Error("not subscribed to the device")
+	}
+	if got, ok := registry.Broker("rabbitf3"); !ok || got != b {
+		t.Errorf("broker %v, %v", got, ok)
+	}
+	f, _ := hub.Get("rabbitf3")
+	if f.Device.Name != testDescriptor.Name || f.State != StateDiscovered {
+		t.Errorf("feeder %+v", f)
+	}
+
+	// announcing again changes nothing
+	d, _ := json.Marshal(protocol.Device{ID: "rabbitf3"})
+	c.deliver(protocol.DiscoveryTopic, d)
+	time.Sleep(20 * time.Millisecond)
+	if n := c.calls("info"); n != 1 {
+		t.Errorf("described %d times", n)
+	}
+
+	// invalid IDs are not subscribed to
+	d, _ = json.Marshal(protocol.Device{ID: "#"})
+	c.deliver(protocol.DiscoveryTopic, d)
+	if _, ok := registry.Broker("#"); ok {
+		t.Error("invalid ID registered")
+	}
+}
+
+func TestRegistryMoved(t *testing.T) {
+	b1, c1 := setup(t)
+	discover(t, c1, "rabbitf3")
+
+	c2 := newFakeClient()
+	c2.device = fakeDevice
+	b2 := &Broker{BrokerConfig: BrokerConfig{Name: "other", ClientID: "other"}, client: c2}
+	brokers = append(brokers, b2)
+	b2.onConnect(c2)
+	d, _ := json.Marshal(protocol.Device{ID: "rabbitf3"})
+	c2.deliver(protocol.DiscoveryTopic, d)
+
+	eventually(t, "the subscription on the new broker", func() bool {
+		return c2.subscribed(protocol.DeviceSubscription("rabbitf3"))
+	})
+	eventually(t, "the unsubscription from the old broker", func() bool {
+		return !c1.subscribed(protocol.DeviceSubscription("rabbitf3"))
+	})
+	if b, _ := registry.Broker("rabbitf3"); b != b2 {
+		t.Errorf("broker %s, want %s", b.Name, b2.Name)
+	}
+	if b, err := brokerOf("rabbitf3"); err != nil || b == b1 {
+		t.Errorf("calls go to %v, %v", b, err)
+	}
+}
+
+// TestRegistryResubscribe reconnects with a clean session, which drops
+// every subscription.
+func TestRegistryResubscribe(t *testing.T) {
+	b, c := setup(t)
+	discover(t, c, "rabbitf3")
+
+	c.mu.Lock()
+	for topic := range c.subs {
+		delete(c.subs, topic)
+	}
+	c.mu.Unlock()
+	b.onConnect(c)
+
+	if !c.subscribed(protocol.DeviceSubscription("rabbitf3")) || !c.subscribed(b.replyTopic()) {
+		t.Errorf("subscriptions %v", c.subs)
+	}
+	if subscribed, pending := subscription("rabbitf3"); !subscribed || pending {
+		t.Errorf("subscribed %v, pending %v", subscribed, pending)
+	}
+	eventually(t, "the descriptor to be asked again", func() bool { return c.calls("info") == 2 })
+}
+
+func TestRegistryRetry(t *testing.T) {
+	_, c := setup(t)
+	c.subErr = errors.New("not authorized")
+	d, _ := json.Marshal(protocol.Device{ID: "rabbitf3"})
+	c.deliver(protocol.DiscoveryTopic, d)
+	eventually(t, "the failed subscription", func() bool {
+		subscribed, pending := subscription("rabbitf3")
+		return !subscribed && !pending
+	})
+
+	// no retry while disconnected
+	c.mu.Lock()
+	c.closed, c.subErr = true, nil
+	c.mu.Unlock()
+	registry.Retry()
+	time.Sleep(20 * time.Millisecond)
+	if c.subscribed(protocol.DeviceSubscription("rabbitf3")) {
+		t.Fatal("subscribed while disconnected")
+	}
+
+	c.mu.Lock()
+	c.closed = false
+	c.mu.Unlock()
+	registry.Retry()
+	eventually(t, "the retried subscription", func() bool {
+		subscribed, _ := subscription("rabbitf3")
+		return subscribed
+	})
+	if !c.subscribed(protocol.DeviceSubscription("rabbitf3")) {
+		t.Error("not subscribed to the device")
+	}
+}
+
+func TestRegistryForget(t *testing.T) {
+	_, c := setup(t)
+	discover(t, c, "rabbitf3")
+
+	if err := forgetDevice("rabbitf3", false); err != nil {
+		t.Fatal(err)
+	}
+	if c.subscribed(protocol.DeviceSubscription("rabbitf3")) {
+		t.Error("still subscribed")
+	}
+	if _, ok := registry.Broker("rabbitf3"); ok {
+		t.Error("still registered")
+	}
+	if _, ok := hub.Get("rabbitf3"); ok {
+		t.Error("still in the hub")
+	}
+	if err := registry.Forget("rabbitf3"); err != errUnknownDevice {
+		t.Errorf("forgetting twice: %v", err)
+	}
+
+	// messages in flight are dropped
+	temp := int32(21000)
+	s, _ := json.Marshal(protocol.SensorState{Schema: protocol.SchemaVersion, Temperature: &temp})
+	deviceHandler(c, fakeMessage{topic: protocol.SensorStateTopic("rabbitf3"), payload: s})
+	ev, _ := json.Marshal(protocol.Event{ID: "rabbitf3", Message: "Food dispensed",
+		Extra: []protocol.Param{{Name: "event", Type: "string", Value: "feeding"}}})
+	c.deliver(protocol.EventsTopic, ev)
+	if _, ok := hub.Get("rabbitf3"); ok {
+		t.Error("forgotten device came back")
+	}
+	if events, _ := store.Events("rabbitf3", "", time.Now().Add(-time.Hour), time.Now()); len(events) != 0 {
+		t.Errorf("events of a forgotten device stored: %+v", events)
+	}
+
+	// it comes back when it announces itself
+	discover(t, c, "rabbitf3")
+	c.deliver(protocol.EventsTopic, ev)
+	if events, _ := store.Events("rabbitf3", "feeding", time.Now().Add(-time.Hour), time.Now()); len(events) != 1 {
+		t.Errorf("%d events stored, want 1", len(events))
+	}
+}
+
+func TestStateOf(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sensors := &protocol.SensorState{}
+	tests := []struct {
+		lastSeen time.Time
+		sensors  *protocol.SensorState
+		want     string
+	}{
+		{time.Time{}, nil, StateOffline},
+		{now, nil, StateDiscovered},
+		{now.Add(-time.Minute), nil, StateDiscovered},
+		{now, sensors, StateOnline},
+		{now.Add(-staleAfter + time.Second), sensors, StateOnline},
+		{now.Add(-staleAfter), sensors, StateStale},
+		{now.Add(-staleAfter), nil, StateStale},
+		{now.Add(-offlineAfter + time.Second), sensors, StateStale},
+		{now.Add(-offlineAfter), sensors, StateOffline},
+		{time.Time{}, sensors, StateOffline},
+	}
+	for _, tt := range tests {
+		f := Feeder{LastSeen: tt.lastSeen, Sensors: tt.sensors}
+		if got := stateOf(&f, now); got != tt.want {
+			t.Errorf("seen %s ago, sensors %v: %s, want %s", now.Sub(tt.lastSeen), tt.sensors != nil, got, tt.want)
+		}
+	}
+}
+
+// TestHubRefresh follows a feeder through the states as time passes.
+func TestHubRefresh(t *testing.T) {
+	hub = NewHub(nil)
+	updates, done := hub.Listen()
+	defer done()
+
+	hub.Update("rabbitf3", func(f *Feeder) {})
+	if f := <-updates; f.State != StateDiscovered {
+		t.Fatalf("state %s", f.State)
+	}
+	hub.Update("rabbitf3", func(f *Feeder) { f.Sensors = &protocol.SensorState{} })
+	if f := <-updates; f.State != StateOnline {
+		t.Fatalf("state %s", f.State)
+	}
+	seen := time.Now()
+	for _, step := range []struct {
+		after time.Duration
+		want  string
+	}{
+		{staleAfter + time.Second, StateStale},
+		{offlineAfter + time.Second, StateOffline},
+	} {
+		hub.Refresh(seen.Add(step.after))
+		select {
+		case f := <-updates:
+			if f.State != step.want {
+				t.Errorf("after %s: %s, want %s", step.after, f.State, step.want)
+			}
+		default:
+			t.Errorf("after %s: no update", step.after)
+		}
+	}
+	// unchanged states are not sent again
+	hub.Refresh(seen.Add(offlineAfter + time.Minute))
+	select {
+	case f := <-updates:
+		t.Errorf("unexpected update %s", f.State)
+	default:
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// Store persists the telemetry of every feeder as JSON lines, one
+// directory per device and one file per series and UTC day:
+//
+//	<dir>/<id>/raw-2006-01-02.jsonl     every Sample received
+//	<dir>/<id>/hourly-2006-01-02.jsonl  one Aggregate per hour
+//	<dir>/<id>/events-2006-01-02.jsonl  every EventRecord, feedings included
+//
+// Maintain downsamples the raw samples of past days to hourly aggregates
+// and removes the files older than the retention of their series.
+type Store struct {
+	dir       string
+	retention Retention
+
+	mu sync.Mutex
+}
+
+// Retention is how long every series is kept, zero keeps it forever.
+type Retention struct {
+	Raw    time.Duration
+	Hourly time.Duration
+	Events time.Duration
+}
+
+var DefaultRetention = Retention{
+	Raw:    30 * 24 * time.Hour,
+	Hourly: 2 * 365 * 24 * time.Hour,
+	Events: 365 * 24 * time.Hour,
+}
+
+// Series stored for every device.
+const (
+	SeriesRaw    = "raw"
+	SeriesHourly = "hourly"
+	SeriesEvents = "events"
+)
+
+const dayLayout = "2006-01-02"
+
+var (
+	validID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	errInvalidID = errors.New("invalid device id")
+)
+
+// Sample is a sensor reading in SI units, missing readings are nil.
+type Sample struct {
+	Time        time.Time `json:"t"`
+	Temperature *float32  `json:"temperature,omitempty"`
+	Humidity    *float32  `json:"humidity,omitempty"`
+	Pressure    *float32  `json:"pressure,omitempty"`
+	Distance    *uint16   `json:"distance,omitempty"`
+	Level       *uint8    `json:"level,omitempty"`
+}
+
+// Stat summarises the samples of an hour.
+type Stat struct {
+	Min float32 `json:"min"`
+	Max float32 `json:"max"`
+	Avg float32 `json:"avg"`
+
+	n   int
+	sum float32
+}
+
+func (s *Stat) add(v float32) {
+	if s.n == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.n == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.n++
+	s.sum += v
+	s.Avg = s.sum / float32(s.n)
+}
+
+// Aggregate is the downsampled form of the samples of one hour.
+type Aggregate struct {
+	Time        time.Time `json:"t"`
+	Count       int       `json:"count"`
+	Temperature *Stat     `json:"temperature,omitempty"`
+	Humidity    *Stat     `json:"humidity,omitempty"`
+	Pressure    *Stat     `json:"pressure,omitempty"`
+	Level       *Stat     `json:"level,omitempty"`
+}
+
+// EventRecord is an event with the time the dashboard received it, the
+// device only sets Event.Time when its clock is valid.
+type EventRecord struct {
+	Time  time.Time      `json:"t"`
+	Event protocol.Event `json:"event"`
+}
+
+func NewStore(dir string, retention Retention) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, retention: retention}, nil
+}
+
+// sampleFromState converts a SensorState to SI units, the readings the
+// feeder could not take are missing from both.
+func sampleFromState(t time.Time, s *protocol.SensorState) Sample {
+	sample := Sample{Time: t}
+	if s.Temperature != nil {
+		v := protocol.Celsius(*s.Temperature)
+		sample.Temperature = &v
+	}
+	if s.Humidity != nil {
+		v := protocol.RelativeHumidity(*s.Humidity)
+		sample.Humidity = &v
+	}
+	if s.Pressure != nil {
+		v := protocol.Pascal(*s.Pressure)
+		sample.Pressure = &v
+	}
+	sample.Distance = s.Distance
+	sample.Level = s.Level
+	return sample
+}
+
+func (st *Store) path(id, series string, day time.Time) string {
+	return filepath.Join(st.dir, id, series+"-"+day.UTC().Format(dayLayout)+".jsonl")
+}
+
+func (st *Store) append(id, series string, t time.Time, v interface{}) error {
+	if !validID.MatchString(id) {
+		return errInvalidID
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := os.MkdirAll(filepath.Join(st.dir, id), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(st.path(id, series, t), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (st *Store) AddSample(id string, s Sample) error {
+	return st.append(id, SeriesRaw, s.Time, s)
+}
+
+func (st *Store) AddEvent(id string, r EventRecord) error {
+	return st.append(id, SeriesEvents, r.Time, r)
+}
+
+// read decodes the lines of the files of series between from and to, fn
+// is called with the raw JSON of every line in order.
+func (st *Store) read(id, series string, from, to time.Time, fn func(line []byte) error) error {
+	if !validID.MatchString(id) {
+		return errInvalidID
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	from, to = from.UTC(), to.UTC()
+	for day := from.Truncate(24 * time.Hour); !day.After(to); day = day.Add(24 * time.Hour) {
+		f, err := os.Open(st.path(id, series, day))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if err := fn(scanner.Bytes()); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inRange(t, from, to time.Time) bool {
+	return !t.Before(from) && !t.After(to)
+}
+
+// Samples returns the raw samples received between from and to.
+func (st *Store) Samples(id string, from, to time.Time) ([]Sample, error) {
+	list := []Sample{}
+	err := st.read(id, SeriesRaw, from, to, func(line []byte) error {
+		var s Sample
+		if err := json.Unmarshal(line, &s); err != nil {
+			return err
+		}
+		if inRange(s.Time, from, to) {
+			list = append(list, s)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// Aggregates returns the hourly aggregates between from and to.
+func (st *Store) Aggregates(id string, from, to time.Time) ([]Aggregate, error) {
+	list := []Aggregate{}
+	err := st.read(id, SeriesHourly, from, to, func(line []byte) error {
+		var a Aggregate
+		if err := json.Unmarshal(line, &a); err != nil {
+			return err
+		}
+		if inRange(a.Time, from, to) {
+			list = append(list, a)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// Events returns the events received between from and to, only the ones
+// of the given kind when it is not empty.
+func (st *Store) Events(id, kind string, from, to time.Time) ([]EventRecord, error) {
+	list := []EventRecord{}
+	err := st.read(id, SeriesEvents, from, to, func(line []byte) error {
+		var r EventRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if inRange(r.Time, from, to) && (kind == "" || r.Event.Kind() == kind) {
+			list = append(list, r)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// Remove deletes everything stored for the device.
+func (st *Store) Remove(id string) error {
+	if !validID.MatchString(id) {
+		return errInvalidID
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return os.RemoveAll(filepath.Join(st.dir, id))
+}
+
+// Devices returns the IDs of the devices with stored data.
+func (st *Store) Devices() ([]string, error) {
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && validID.MatchString(e.Name()) {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Maintain downsamples every raw day before now that has no hourly file
+// yet, then applies the retention.
+func (st *Store) Maintain(now time.Time) error {
+	ids, err := st.Devices()
+	if err != nil {
+		return err
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	for _, id := range ids {
+		files, err := st.files(id)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.series != SeriesRaw || !f.day.Before(today) {
+				continue
+			}
+			if _, err := os.Stat(st.path(id, SeriesHourly, f.day)); err == nil {
+				continue
+			}
+			if err := st.downsample(id, f.day); err != nil {
+				return err
+			}
+		}
+		for _, f := range files {
+			keep := st.retentionOf(f.series)
+			if keep > 0 && f.day.Add(24*time.Hour).Before(now.Add(-keep)) {
+				if err := os.Remove(f.path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (st *Store) retentionOf(series string) time.Duration {
+	switch series {
+	case SeriesRaw:
+		return st.retention.Raw
+	case SeriesHourly:
+		return st.retention.Hourly
+	case SeriesEvents:
+		return st.retention.Events
+	}
+	return 0
+}
+
+type storeFile struct {
+	path   string
+	series string
+	day    time.Time
+}
+
+func (st *Store) files(id string) ([]storeFile, error) {
+	entries, err := os.ReadDir(filepath.Join(st.dir, id))
+	if err != nil {
+		return nil, err
+	}
+	var files []storeFile
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".jsonl")
+		if len(name) <= len(dayLayout)+1 || name == e.Name() {
+			continue
+		}
+		series, date := name[:len(name)-len(dayLayout)-1], name[len(name)-len(dayLayout):]
+		day, err := time.Parse(dayLayout, date)
+		if err != nil {
+			continue
+		}
+		files = append(files, storeFile{path: filepath.Join(st.dir, id, e.Name()), series: series, day: day})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].day.Before(files[j].day) })
+	return files, nil
+}
+
+// downsample writes the hourly aggregates of the raw samples of day.
+func (st *Store) downsample(id string, day time.Time) error {
+	samples, err := st.Samples(id, day, day.Add(24*time.Hour-time.Nanosecond))
+	if err != nil {
+		return err
+	}
+	var aggregates []*Aggregate
+	var current *Aggregate
+	for _, s := range samples {
+		hour := s.Time.UTC().Truncate(time.Hour)
+		if current == nil || !current.Time.Equal(hour) {
+			current = &Aggregate{Time: hour}
+			aggregates = append(aggregates, current)
+		}
+		current.Count++
+		addStat(&current.Temperature, s.Temperature)
+		addStat(&current.Humidity, s.Humidity)
+		addStat(&current.Pressure, s.Pressure)
+		if s.Level != nil {
+			v := float32(*s.Level)
+			addStat(&current.Level, &v)
+		}
+	}
+
+	// an empty file marks the day as done
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, err := os.Create(st.path(id, SeriesHourly, day))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, a := range aggregates {
+		if err := enc.Encode(a); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func addStat(s **Stat, v *float32) {
+	if v == nil {
+		return
+	}
+	if *s == nil {
+		*s = &Stat{}
+	}
+	(*s).add(*v)
+}
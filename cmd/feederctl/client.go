@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var errTimeout = errors.New("timeout waiting for the device")
+
+// Client talks to the feeders through the broker.
+type Client struct {
+	mqtt    mqtt.Client
+	id      string
+	token   string
+	timeout time.Duration
+	callID  uint64
+}
+
+// Options are the broker settings, from the flags or the environment.
+type Options struct {
+	Broker   string
+	User     string
+	Password string
+	ClientID string
+	Token    string
+	Timeout  time.Duration
+}
+
+func Connect(o Options) (*Client, error) {
+	if o.ClientID == "" {
+		o.ClientID = "feederctl-" + strconv.Itoa(os.Getpid())
+	}
+	opts := mqtt.NewClientOptions().AddBroker(o.Broker)
+	opts.SetClientID(o.ClientID)
+	opts.SetUsername(o.User)
+	opts.SetPassword(o.Password)
+	opts.SetConnectTimeout(o.Timeout)
+
+	c := &Client{mqtt: mqtt.NewClient(opts), id: o.ClientID, token: o.Token, timeout: o.Timeout}
+	if err := wait(c.mqtt.Connect()); err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", o.Broker, err)
+	}
+	return c, nil
+}
+
+func (c *Client) Close() {
+	c.mqtt.Disconnect(250)
+}
+
+func wait(t mqtt.Token) error {
+	t.Wait()
+	return t.Error()
+}
+
+func (c *Client) replyTopic() string {
+	return protocol.ReplyPrefix + "feederctl/" + c.id
+}
+
+// Call calls a method of the device and decodes its result into result,
+// which may be nil.
+func (c *Client) Call(id, method string, params, result interface{}) error {
+	req, err := protocol.NewRequest(strconv.FormatUint(atomic.AddUint64(&c.callID, 1), 10), method, params)
+	if err != nil {
+		return err
+	}
+	req.Reply = c.replyTopic()
+	req.Token = c.token
+
+	replies := make(chan []byte, 1)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		var res protocol.Response
+		if json.Unmarshal(msg.Payload(), &res) == nil && res.ID == req.ID {
+			select {
+			case replies <- msg.Payload():
+			default:
+			}
+		}
+	}
+	if err := wait(c.mqtt.Subscribe(req.Reply, 0, handler)); err != nil {
+		return err
+	}
+	defer c.mqtt.Unsubscribe(req.Reply)
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := wait(c.mqtt.Publish(protocol.CallTopic(id), 0, false, data)); err != nil {
+		return err
+	}
+
+	select {
+	case payload := <-replies:
+		res, err := protocol.DecodeResponse(payload, result)
+		if err != nil {
+			return err
+		}
+		if res.Error != "" {
+			return fmt.Errorf("%s %s: %s", id, method, res.Error)
+		}
+		return nil
+	case <-time.After(c.timeout):
+		return fmt.Errorf("%s %s: %w", id, method, errTimeout)
+	}
+}
+
+// Discover asks the feeders to announce themselves and collects the
+// announcements received during d.
+func (c *Client) Discover(d time.Duration) ([]protocol.Device, error) {
+	found := make(chan protocol.Device, 16)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		var dev protocol.Device
+		if json.Unmarshal(msg.Payload(), &dev) == nil && dev.ID != "" {
+			found <- dev
+		}
+	}
+	if err := wait(c.mqtt.Subscribe(protocol.DiscoveryTopic, 0, handler)); err != nil {
+		return nil, err
+	}
+	defer c.mqtt.Unsubscribe(protocol.DiscoveryTopic)
+	if err := wait(c.mqtt.Publish(protocol.DiscoveryRequestTopic, 0, false, "")); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var devices []protocol.Device
+	deadline := time.After(d)
+	for {
+		select {
+		case dev := <-found:
+			if !seen[dev.ID] {
+				seen[dev.ID] = true
+				devices = append(devices, dev)
+			}
+		case <-deadline:
+			return devices, nil
+		}
+	}
+}
+
+// Events calls fn with every event published by the feeders, or only by
+// the device id when it is not empty, until stop is closed.
+func (c *Client) Events(id string, stop <-chan struct{}, fn func(protocol.Event)) error {
+	events := make(chan protocol.Event, 16)
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		var ev protocol.Event
+		if json.Unmarshal(msg.Payload(), &ev) == nil && (id == "" || ev.ID == id) {
+			events <- ev
+		}
+	}
+	if err := wait(c.mqtt.Subscribe(protocol.EventsTopic, 0, handler)); err != nil {
+		return err
+	}
+	defer c.mqtt.Unsubscribe(protocol.EventsTopic)
+	for {
+		select {
+		case ev := <-events:
+			fn(ev)
+		case <-stop:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+const (
+	// eepromSize and eepromChunk match the AT24C32 of the feeder and the
+	// largest read it answers.
+	eepromSize  = 4096
+	eepromChunk = 128
+)
+
+var commands = map[string]func(args []string) error{
+	"list":     listCmd,
+	"status":   statusCmd,
+	"feed":     feedCmd,
+	"relay":    relayCmd,
+	"schedule": scheduleCmd,
+	"eeprom":   eepromCmd,
+	"logs":     logsCmd,
+	"time":     timeCmd,
+	"i2c":      i2cCmd,
+}
+
+func listCmd(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	wait := fs.Duration("wait", 3*time.Second, "how long to wait for the announcements")
+	if args, err := parse(fs, args); err != nil || len(args) != 0 {
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	devices, err := c.Discover(*wait)
+	if err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(devices)
+	}
+	rows := [][]string{{"ID", "NAME", "VERSION"}}
+	for _, d := range devices {
+		rows = append(rows, []string{d.ID, d.Name, d.Version})
+	}
+	return printTable(rows)
+}
+
+func statusCmd(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	var s protocol.Status
+	if err := c.Call(args[0], "status", nil, &s); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(s)
+	}
+	var distance *int32
+	if s.Sensors.Distance != nil {
+		d := int32(*s.Sensors.Distance)
+		distance = &d
+	}
+	hopper := "-"
+	if s.Sensors.Level != nil {
+		hopper = fmt.Sprintf("%d %%", *s.Sensors.Level)
+	}
+	rows := [][]string{
+		{"temperature", sensorReading(s.Sensors.Temperature, "%.1f "+protocol.TemperatureUnit, protocol.Celsius, s.Sensors.Readings.Temperature)},
+		{"humidity", sensorReading(s.Sensors.Humidity, "%.1f "+protocol.HumidityUnit, protocol.RelativeHumidity, s.Sensors.Readings.Humidity)},
+		{"pressure", sensorReading(s.Sensors.Pressure, "%.0f "+protocol.PressureUnit, protocol.Pascal, s.Sensors.Readings.Pressure)},
+		{"distance", sensorReading(distance, "%.0f "+protocol.DistanceUnit, millimetres, s.Sensors.Readings.Distance)},
+		{"hopper", hopper},
+		{"time", orDash(s.Sensors.Timestamp)},
+		{"time valid", strconv.FormatBool(s.Sensors.TimeValid)},
+		{"last sync", orDash(s.Sensors.LastSync)},
+		{"relay 1", s.Relays.Relay1},
+		{"relay 2", s.Relays.Relay2},
+		{"relay 3", s.Relays.Relay3},
+		{"relay 4", s.Relays.Relay4},
+		{"motor", s.Motor},
+		{"missing devices", orDash(missingDevices(s.Sensors.Devices))},
+	}
+	return printTable(rows)
+}
+
+func feedCmd(args []string) error {
+	fs := flag.NewFlagSet("feed", flag.ContinueOnError)
+	grams := fs.Uint("grams", 0, "quantity of food in grams")
+	args, err := parse(fs, args)
+	if err != nil || len(args) != 1 || *grams == 0 {
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	var fed uint32
+	if err := c.Call(args[0], "food", map[string]uint{"q": *grams}, &fed); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(map[string]interface{}{"id": args[0], "grams": fed})
+	}
+	fmt.Printf("%s: dispensing %d g\n", args[0], fed)
+	return nil
+}
+
+// relayCmd sends a protocol.RelayCommand, its words are the remaining
+// arguments.
+func relayCmd(args []string) error {
+	if len(args) < 3 {
+		return errUsage
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 || n > 4 {
+		return errUsage
+	}
+	cmd, err := protocol.ParseRelayCommand(strings.Join(args[2:], " "))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errUsage, err)
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	var r protocol.RelayState
+	if err := c.Call(args[0], "relay", map[string]interface{}{"r": n, "s": cmd.String()}, &r); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(r)
+	}
+	return printTable([][]string{
+		{"RELAY 1", "RELAY 2", "RELAY 3", "RELAY 4"},
+		{r.Relay1, r.Relay2, r.Relay3, r.Relay4},
+		{relayTimer(r.Timer1), relayTimer(r.Timer2), relayTimer(r.Timer3), relayTimer(r.Timer4)},
+	})
+}
+
+func scheduleCmd(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	var params interface{}
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			return errUsage
+		}
+	case "set":
+		alarms, err := parseAlarms(args[2:])
+		if err != nil {
+			return err
+		}
+		params = alarms
+	default:
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	var alarms []protocol.Alarm
+	if err := c.Call(args[1], "schedule", params, &alarms); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(alarms)
+	}
+	rows := [][]string{{"#", "TIME", "GRAMS", "ENABLED", "LAST", "NEXT"}}
+	for i, a := range alarms {
+		rows = append(rows, []string{
+			strconv.Itoa(i),
+			fmt.Sprintf("%02d:%02d", a.Hour, a.Minute),
+			strconv.FormatUint(uint64(a.Quantity), 10),
+			strconv.FormatBool(a.Enabled),
+			unixTime(a.Last),
+			unixTime(a.Next),
+		})
+	}
+	return printTable(rows)
+}
+
+// parseAlarms reads the feedings as HH:MM=grams, "off" leaves a slot
+// disabled.
+func parseAlarms(args []string) ([]protocol.Alarm, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	alarms := make([]protocol.Alarm, len(args))
+	for i, arg := range args {
+		if arg == "off" {
+			continue
+		}
+		at, grams, ok := strings.Cut(arg, "=")
+		t, err := time.Parse("15:04", at)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%w: %q is not HH:MM=grams", errUsage, arg)
+		}
+		q, err := strconv.ParseUint(grams, 10, 32)
+		if err != nil || q == 0 {
+			return nil, fmt.Errorf("%w: invalid quantity in %q", errUsage, arg)
+		}
+		alarms[i] = protocol.Alarm{Hour: uint8(t.Hour()), Minute: uint8(t.Minute()), Enabled: true, Quantity: uint32(q)}
+	}
+	return alarms, nil
+}
+
+// relayTimer prints the seconds left before a relay reverts.
+func relayTimer(s uint32) string {
+	if s == 0 {
+		return "-"
+	}
+	return (time.Duration(s) * time.Second).String()
+}
+
+// sensorReading prints a wire reading converted to its unit, with its age
+// when it is not fresh and the failed reads.
+func sensorReading(v *int32, format string, convert func(int32) float32, r protocol.ReadingState) string {
+	s := "-"
+	if v != nil {
+		s = fmt.Sprintf(format, convert(*v))
+		if r.Age != nil && *r.Age > 0 {
+			s += fmt.Sprintf(" (%s ago)", time.Duration(*r.Age)*time.Second)
+		}
+	}
+	if r.Errors > 0 {
+		s += fmt.Sprintf(", %d errors", r.Errors)
+	}
+	return s
+}
+
+func millimetres(v int32) float32 {
+	return float32(v)
+}
+
+// missingDevices lists the I2C devices the feeder did not find.
+func missingDevices(d protocol.Devices) string {
+	var missing []string
+	for _, dev := range []struct {
+		name  string
+		found bool
+	}{{"BME280", d.BME280}, {"RTC", d.RTC}, {"EEPROM", d.EEPROM}, {"VL6180X", d.VL6180X}} {
+		if !dev.found {
+			missing = append(missing, dev.name)
+		}
+	}
+	return strings.Join(missing, ", ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func unixTime(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
+
+func eepromCmd(args []string) error {
+	if len(args) == 0 || args[0] != "dump" {
+		return errUsage
+	}
+	fs := flag.NewFlagSet("eeprom dump", flag.ContinueOnError)
+	from := fs.Int("from", 0, "first byte")
+	length := fs.Int("length", eepromSize, "number of bytes")
+	args, err := parse(fs, args[1:])
+	if err != nil || len(args) != 1 || *from < 0 || *length <= 0 || *from+*length > eepromSize {
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	dump := protocol.EEPROMReply{P: *from}
+	for p := *from; p < *from+*length; p += eepromChunk {
+		n := eepromChunk
+		if p+n > *from+*length {
+			n = *from + *length - p
+		}
+		var r protocol.EEPROMReply
+		if err := c.Call(args[0], "gm", protocol.EEPROMRequest{P: p, N: n}, &r); err != nil {
+			return err
+		}
+		dump.Data = append(dump.Data, r.Data...)
+	}
+	if *jsonOut {
+		return printJSON(dump)
+	}
+	hexDump(os.Stdout, dump.P, dump.Data)
+	return nil
+}
+
+func logsCmd(args []string) error {
+	if len(args) == 0 || args[0] != "tail" || len(args) > 2 {
+		return errUsage
+	}
+	var id string
+	if len(args) == 2 {
+		id = args[1]
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+	return c.Events(id, stop, func(ev protocol.Event) {
+		if *jsonOut {
+			printJSON(ev)
+			return
+		}
+		printEvent(ev)
+	})
+}
+
+func timeCmd(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	var method string
+	switch args[0] {
+	case "get":
+		method = "grtc"
+	case "sync":
+		method = "sync"
+	default:
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	if method == "sync" {
+		var res string
+		if err := c.Call(args[1], method, nil, &res); err != nil {
+			return err
+		}
+		if *jsonOut {
+			return printJSON(map[string]string{"id": args[1], "sync": res})
+		}
+		fmt.Printf("%s: synchronisation %s\n", args[1], res)
+		return nil
+	}
+
+	var t protocol.RTCTime
+	if err := c.Call(args[1], method, nil, &t); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(t)
+	}
+	return printTable([][]string{
+		{"utc", t.Timestamp},
+		{"local", t.Local},
+		{"valid", strconv.FormatBool(t.TimeValid)},
+	})
+}
+
+func i2cCmd(args []string) error {
+	fs := flag.NewFlagSet("i2c", flag.ContinueOnError)
+	scan := fs.Bool("scan", false, "scan the bus for the addresses that answer")
+	args, err := parse(fs, args)
+	if err != nil || len(args) != 1 {
+		return errUsage
+	}
+	c, err := client()
+	if err != nil {
+		return err
+	}
+	var s protocol.I2CState
+	if err := c.Call(args[0], "i2c", map[string]bool{"scan": *scan}, &s); err != nil {
+		return err
+	}
+	if *jsonOut {
+		return printJSON(s)
+	}
+	rows := [][]string{{"DEVICE", "ERRORS", "TIMEOUTS"}}
+	for _, d := range []struct {
+		name  string
+		stats protocol.I2CStats
+	}{{"BME280", s.BME280}, {"RTC", s.RTC}, {"EEPROM", s.EEPROM}, {"VL6180X", s.VL6180X}} {
+		rows = append(rows, []string{d.name, strconv.Itoa(int(d.stats.Errors)), strconv.Itoa(int(d.stats.Timeouts))})
+	}
+	rows = append(rows, []string{"recoveries", strconv.Itoa(int(s.Recoveries)), ""})
+	if *scan {
+		var found []string
+		for _, addr := range s.Scan {
+			found = append(found, fmt.Sprintf("0x%02x", addr))
+		}
+		rows = append(rows, []string{"scan", orDash(strings.Join(found, " ")), ""})
+	}
+	return printTable(rows)
+}
@@ -0,0 +1,16 @@
+module github.com/conejoninja/rabbit-feeder/cmd/feederctl
+
+go 1.20
+
+require (
+	github.com/conejoninja/rabbit-feeder v0.0.0-00010101000000-000000000000
+	github.com/eclipse/paho.mqtt.golang v1.4.2
+)
+
+require (
+	github.com/gorilla/websocket v1.4.2 // indirect
+	golang.org/x/net v0.0.0-20200425230154-ff2c4b7c35a0 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+)
+
+replace github.com/conejoninja/rabbit-feeder => ../..
@@ -0,0 +1,114 @@
+// feederctl drives the feeders over MQTT from the command line.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+const usage = `usage: feederctl [flags] <command> [args]
+
+commands:
+  list                                feeders answering the discovery request
+  status <id>                         sensors, relays and motor
+  feed <id> --grams N                 dispense food
+  relay <id> <1-4> <command>          on, off, toggle, on for 10m, pulse 500ms
+  schedule get <id>                   feeding schedule
+  schedule set <id> HH:MM=grams|off…  replace the feeding schedule
+  eeprom dump <id> [--from P] [--length N]
+  logs tail [id]                      print the events until interrupted
+  time get <id>                       RTC time
+  time sync <id>                      synchronise the RTC over SNTP
+  i2c <id> [--scan]                   I2C error counters, addresses that answer
+
+flags:
+`
+
+var errUsage = errors.New("invalid arguments, see feederctl -h")
+
+var (
+	broker   = flag.String("broker", env("FEEDER_BROKER", "tcp://localhost:1883"), "MQTT broker URL, $FEEDER_BROKER")
+	user     = flag.String("user", env("FEEDER_USER", ""), "MQTT user, $FEEDER_USER")
+	password = flag.String("password", env("FEEDER_PASSWORD", ""), "MQTT password, $FEEDER_PASSWORD")
+	clientID = flag.String("client-id", env("FEEDER_CLIENT_ID", ""), "MQTT client ID, $FEEDER_CLIENT_ID")
+	token    = flag.String("token", env("FEEDER_TOKEN", ""), "command token of the protected methods, $FEEDER_TOKEN")
+	timeout  = flag.Duration("timeout", 10*time.Second, "how long to wait for the device")
+	jsonOut  = flag.Bool("json", false, "print JSON instead of tables")
+)
+
+func env(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := cmd(flag.Args()[1:])
+	if conn != nil {
+		conn.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+var conn *Client
+
+// client connects to the broker on first use, once the arguments of the
+// command are checked.
+func client() (*Client, error) {
+	if conn != nil {
+		return conn, nil
+	}
+	var err error
+	conn, err = Connect(Options{
+		Broker:   *broker,
+		User:     *user,
+		Password: *password,
+		ClientID: *clientID,
+		Token:    *token,
+		Timeout:  *timeout,
+	})
+	return conn, err
+}
+
+// parse parses the flags of a command, which may come before or after its
+// positional arguments, and returns the positional ones.
+func parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
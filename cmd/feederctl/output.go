@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printTable aligns the columns of the rows, the first one is usually the
+// header.
+func printTable(rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+var priorityNames = map[uint8]string{
+	protocol.PriorityInfo:     "info",
+	protocol.PriorityWarning:  "warning",
+	protocol.PriorityCritical: "critical",
+}
+
+// printEvent prints an event on one line, with its extra parameters as
+// name=value. Events without a device time get the local one.
+func printEvent(ev protocol.Event) {
+	t := ev.Time
+	if t == "" {
+		t = time.Now().Format(time.RFC3339)
+	}
+	var extra []string
+	for _, p := range ev.Extra {
+		if p.Name != "event" {
+			extra = append(extra, p.Name+"="+p.Value)
+		}
+	}
+	fmt.Printf("%s %s %-8s %s: %s %s\n", t, ev.ID, priorityNames[ev.Priority], ev.Kind(), ev.Message, strings.Join(extra, " "))
+}
+
+// hexDump prints data like hexdump -C, with offsets starting at p.
+func hexDump(w io.Writer, p int, data []byte) {
+	for i := 0; i < len(data); i += 16 {
+		line := data[i:]
+		if len(line) > 16 {
+			line = line[:16]
+		}
+		fmt.Fprintf(w, "%04x  ", p+i)
+		for j := 0; j < 16; j++ {
+			if j < len(line) {
+				fmt.Fprintf(w, "%02x ", line[j])
+			} else {
+				fmt.Fprint(w, "   ")
+			}
+			if j == 7 {
+				fmt.Fprint(w, " ")
+			}
+		}
+		ascii := make([]byte, len(line))
+		for j, b := range line {
+			ascii[j] = '.'
+			if b >= 0x20 && b < 0x7f {
+				ascii[j] = b
+			}
+		}
+		fmt.Fprintf(w, " |%s|\n", ascii)
+	}
+}
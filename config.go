@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	"github.com/conejoninja/rabbit-feeder/tz"
+)
+
+// The configuration is stored as JSON in its own EEPROM region, preceded by
+// a two byte magic and a two byte length.
+const (
+	ConfigAddress = 256
+	ConfigSize    = 1024
+
+	configMagic0 = 'R'
+	configMagic1 = 'F'
+
+	// defaultMaxOn keeps a relay from being left on by a command without
+	// duration, in seconds.
+	defaultMaxOn = 12 * 60 * 60
+)
+
+// Config holds the settings that can be changed at runtime without flashing
+// the firmware. Missing fields keep their default value.
+type Config struct {
+	// NTPServer is the host queried to set the RTC.
+	NTPServer string `json:"ntp_server,omitempty"`
+	// NTPInterval is the time between synchronisations, in minutes.
+	NTPInterval uint32 `json:"ntp_interval,omitempty"`
+	// TZ is a POSIX TZ rule, e.g. "CET-1CEST,M3.5.0,M10.5.0/3". The
+	// schedule uses it to feed at local time.
+	TZ string `json:"tz,omitempty"`
+	// HopperEmpty and HopperFull are the distances in mm measured by the
+	// VL6180X with an empty and a full hopper.
+	HopperEmpty uint16 `json:"hopper_empty,omitempty"`
+	HopperFull  uint16 `json:"hopper_full,omitempty"`
+	// Relays are the settings of relays 1 to 4.
+	Relays RelayConfigs `json:"relays"`
+	// Interlocks is the interlock table, it replaces the whole table when
+	// set. The rules apply to the next commands.
+	Interlocks []Interlock `json:"interlocks,omitempty"`
+	// Welfare holds the heat-stress bands of the animals.
+	Welfare WelfareConfig `json:"welfare"`
+}
+
+// WelfareConfig classifies the heat-stress index, in HeatStressScale: ok
+// below Warm, warm below Dangerous and dangerous above.
+type WelfareConfig struct {
+	Warm      int32 `json:"warm"`
+	Dangerous int32 `json:"dangerous"`
+	// CoolingRelay, 1 to 4, is turned on while the reading is dangerous.
+	// 0 is none.
+	CoolingRelay int `json:"cooling_relay,omitempty"`
+}
+
+// RelayConfigs merges the received settings into each relay: a shorter
+// array or a null element leaves the following relays unchanged.
+type RelayConfigs [4]RelayConfig
+
+func (r *RelayConfigs) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) > len(r) {
+		return errInvalidRelays
+	}
+	for i := range raw {
+		if err := json.Unmarshal(raw[i], &r[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RelayConfig holds the settings of one relay.
+type RelayConfig struct {
+	// Name and Icon are shown by Home Assistant, Icon is an "mdi:" icon.
+	Name string `json:"name"`
+	Icon string `json:"icon,omitempty"`
+	// Component is the Home Assistant entity of the relay: "switch",
+	// "light", "fan" or "valve".
+	Component string `json:"component"`
+	// Inverted is set for the active-low relay boards, on when the pin is
+	// low.
+	Inverted bool `json:"inverted,omitempty"`
+	// MaxOn is the longest time the relay stays on, in seconds, whatever
+	// the commands received: defaultMaxOn unless set. 0 is no limit.
+	MaxOn uint32 `json:"max_on"`
+	// Thermostat drives the relay from the BME280 when set, null removes
+	// it.
+	Thermostat *Thermostat `json:"thermostat,omitempty"`
+	// PowerOn is the state of the relay at boot: "off", the default, "on"
+	// or "restore" the last state.
+	PowerOn string `json:"power_on,omitempty"`
+}
+
+// Thermostat is a closed-loop controller of a relay. Target and Band use
+// the scale of the sensor, e.g. 18500 for 18.5°C or 6000 for 60% relative
+// humidity.
+type Thermostat struct {
+	// Mode is "hysteresis": the relay switches at the edges of Band around
+	// Target, or "proportional": it is on for a share of every Period, from
+	// 0 at one edge of Band to 100% at the other.
+	Mode string `json:"mode"`
+	// Sensor is "temperature" or "humidity".
+	Sensor string `json:"sensor"`
+	// Action is "heat", on below Target, or "cool", on above it.
+	Action string `json:"action"`
+	// Off holds the relay off, it is the "off" HVAC mode of Home Assistant.
+	Off    bool  `json:"off,omitempty"`
+	Target int32 `json:"target"`
+	Band   int32 `json:"band"`
+	// Period is the cycle of the proportional mode, in seconds.
+	Period uint32 `json:"period,omitempty"`
+	// MinOn and MinOff are the shortest times, in seconds, the relay stays
+	// on and off, to spare compressors and relay contacts.
+	MinOn  uint32 `json:"min_on,omitempty"`
+	MinOff uint32 `json:"min_off,omitempty"`
+	// Failsafe is the state of the relay, "on" or "off", while the sensor
+	// fails. Off when empty.
+	Failsafe string `json:"failsafe,omitempty"`
+	// FailsafeAfter is how long, in seconds, the last good reading is
+	// still used once the sensor fails. 0 applies the failsafe at the
+	// first failed read.
+	FailsafeAfter uint32 `json:"failsafe_after,omitempty"`
+}
+
+var config = defaultConfig()
+
+var (
+	errNoEEPROM           = errors.New("EEPROM not available")
+	errConfigTooLarge     = errors.New("configuration does not fit in the EEPROM")
+	errInvalidNTPServer   = errors.New("ntp_server can not be empty")
+	errInvalidNTPInterval = errors.New("ntp_interval must be at least 15 minutes")
+	errInvalidHopper      = errors.New("hopper_empty must be greater than hopper_full")
+	errInvalidRelays      = errors.New("relays holds at most 4 relays")
+	errInvalidMaxOn       = errors.New("max_on can not be longer than a day")
+	errInvalidThermostat  = errors.New("invalid thermostat")
+	errInvalidPowerOn     = errors.New("power_on must be off, on or restore")
+	errInvalidRelayName   = errors.New("relay name must have 1 to 32 characters")
+	errInvalidRelayIcon   = errors.New("relay icon must be an mdi: icon")
+	errInvalidComponent   = errors.New("relay component must be switch, light, fan or valve")
+	errInvalidWelfare     = errors.New("welfare warm must be positive and below dangerous")
+	errInvalidCooling     = errors.New("welfare cooling_relay must be a relay without thermostat")
+)
+
+var configTopic = protocol.ConfigTopic(DeviceID)
+
+func defaultConfig() Config {
+	return Config{
+		NTPServer:   "pool.ntp.org",
+		NTPInterval: 6 * 60,
+		TZ:          "UTC0",
+		HopperEmpty: 180,
+		HopperFull:  20,
+		Relays: RelayConfigs{
+			{Name: "Relay 1 (USB)", Icon: "mdi:usb-port", Component: "switch", MaxOn: defaultMaxOn},
+			{Name: "Relay 2 (USB)", Icon: "mdi:usb-port", Component: "switch", MaxOn: defaultMaxOn},
+			{Name: "Relay 3 (12V)", Icon: "mdi:audio-input-stereo-minijack", Component: "switch", MaxOn: defaultMaxOn},
+			{Name: "Relay 4 (12V)", Icon: "mdi:audio-input-stereo-minijack", Component: "switch", MaxOn: defaultMaxOn},
+		},
+		// Marai et al. (2001): no heat stress below 27.8, severe above 28.9
+		Welfare: WelfareConfig{Warm: 27800, Dangerous: 28900},
+	}
+}
+
+// loadConfig reads the configuration from the EEPROM, keeping the defaults
+// when the region is empty, corrupted or holds an invalid configuration.
+func loadConfig() {
+	if c, ok := readConfig(); ok {
+		config = c
+		localZone, _ = tz.Parse(config.TZ)
+	}
+}
+
+// readConfig returns the configuration stored in the EEPROM, false when
+// there is none or it is not valid.
+func readConfig() (Config, bool) {
+	if !eepromEnabled {
+		return Config{}, false
+	}
+	header := make([]byte, 4)
+	if _, err := eeprom.ReadAt(header, ConfigAddress); err != nil {
+		println("[CONFIG] error reading EEPROM", err)
+		return Config{}, false
+	}
+	if header[0] != configMagic0 || header[1] != configMagic1 {
+		println("[CONFIG] no configuration stored, using defaults")
+		return Config{}, false
+	}
+	l := int(header[2])<<8 | int(header[3])
+	if l == 0 || l > ConfigSize-4 {
+		println("[CONFIG] invalid configuration length", l)
+		return Config{}, false
+	}
+	raw := make([]byte, l)
+	if _, err := eeprom.ReadAt(raw, ConfigAddress+4); err != nil {
+		println("[CONFIG] error reading EEPROM", err)
+		return Config{}, false
+	}
+	c := defaultConfig()
+	if err := json.Unmarshal(raw, &c); err != nil {
+		println("[CONFIG] error parsing configuration", err.Error())
+		return Config{}, false
+	}
+	// written by an older firmware, or corrupted
+	if err := c.validate(); err != nil {
+		println("[CONFIG] invalid configuration:", err.Error())
+		return Config{}, false
+	}
+	return c, true
+}
+
+// saveConfig writes the configuration to the EEPROM. Without EEPROM it is
+// only kept in RAM, until the next reboot.
+func saveConfig() error {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if len(raw) > ConfigSize-4 {
+		return errConfigTooLarge
+	}
+	if !eepromEnabled {
+		println("[CONFIG] no EEPROM, the configuration is not stored")
+		return nil
+	}
+	buf := make([]byte, 4+len(raw))
+	buf[0], buf[1] = configMagic0, configMagic1
+	buf[2], buf[3] = byte(len(raw)>>8), byte(len(raw))
+	copy(buf[4:], raw)
+	_, err = eeprom.WriteAt(buf, ConfigAddress)
+	return err
+}
+
+// configHandler merges a (partial) JSON configuration received on
+// configTopic/set, in a protocol.SetRequest, validates and stores it.
+func configHandler(payload []byte) {
+	value, err := setValue(payload)
+	if err == nil {
+		err = setConfig(value)
+	}
+	if err != nil {
+		println("[CONFIG]", err.Error())
+	}
+	publishConfig()
+}
+
+// clone returns a copy of the configuration that JSON can be merged into.
+func (c *Config) clone() Config {
+	n := *c
+	n.Interlocks = make([]Interlock, len(c.Interlocks))
+	for i, l := range c.Interlocks {
+		n.Interlocks[i] = Interlock{Rule: l.Rule, Relays: append([]int(nil), l.Relays...)}
+	}
+	for i := range n.Relays {
+		if t := n.Relays[i].Thermostat; t != nil {
+			copy := *t
+			n.Relays[i].Thermostat = &copy
+		}
+	}
+	return n
+}
+
+func setConfig(payload []byte) error {
+	c := config.clone()
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	if raw, err := json.Marshal(c); err != nil || len(raw) > ConfigSize-4 {
+		return errConfigTooLarge
+	}
+	applyConfig(c)
+	return saveConfig()
+}
+
+// applyConfig switches to the configuration c, without storing it.
+func applyConfig(c Config) {
+	if c.TZ != config.TZ {
+		localZone, _ = tz.Parse(c.TZ)
+		resetSchedule()
+	}
+	var wasOn [4]bool
+	for i := range relay {
+		wasOn[i] = relayOn(i)
+	}
+	old := config
+	config = c
+	rewired := false
+	for i := range relay {
+		// a relay is switched off on its new wiring, turning it on there
+		// would skip the interlocks and max_on
+		if c.Relays[i].Inverted != old.Relays[i].Inverted {
+			relay[i].Set(c.Relays[i].Inverted)
+			relayUntil[i] = time.Time{}
+			if wasOn[i] {
+				println("[RELAY]", i+1, "off, its wiring changed")
+				relayChanged[i] = time.Now()
+			}
+			rewired = true
+		}
+	}
+	thermostatCycle = [4]time.Time{}
+	publishRelayDiscovery(&old)
+	publishDescriptor()
+	if rewired {
+		sendRelayStatus()
+	}
+}
+
+func (c *Config) validate() error {
+	c.NTPServer = strings.TrimSpace(c.NTPServer)
+	if c.NTPServer == "" {
+		return errInvalidNTPServer
+	}
+	if c.NTPInterval < 15 {
+		return errInvalidNTPInterval
+	}
+	if _, err := tz.Parse(c.TZ); err != nil {
+		return err
+	}
+	if c.HopperEmpty <= c.HopperFull {
+		return errInvalidHopper
+	}
+	for i := range c.Interlocks {
+		if err := c.Interlocks[i].validate(); err != nil {
+			return err
+		}
+	}
+	if c.Welfare.Warm <= 0 || c.Welfare.Warm >= c.Welfare.Dangerous {
+		return errInvalidWelfare
+	}
+	if n := c.Welfare.CoolingRelay; n < 0 || n > len(c.Relays) || n > 0 && c.Relays[n-1].Thermostat != nil {
+		return errInvalidCooling
+	}
+	for i := range c.Relays {
+		r := &c.Relays[i]
+		if r.Name = strings.TrimSpace(r.Name); r.Name == "" || len(r.Name) > 32 {
+			return errInvalidRelayName
+		}
+		if r.Icon != "" && (!strings.HasPrefix(r.Icon, "mdi:") || len(r.Icon) > 48) {
+			return errInvalidRelayIcon
+		}
+		if !relayComponent(r.Component) {
+			return errInvalidComponent
+		}
+		if time.Duration(r.MaxOn)*time.Second > protocol.MaxRelayTimer {
+			return errInvalidMaxOn
+		}
+		if r.PowerOn != "" && r.PowerOn != PowerOnOff && r.PowerOn != PowerOnOn && r.PowerOn != PowerOnRestore {
+			return errInvalidPowerOn
+		}
+		if r.Thermostat != nil {
+			if err := r.Thermostat.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Thermostat) validate() error {
+	switch {
+	case t.Mode != "hysteresis" && t.Mode != "proportional",
+		t.Action != protocol.ThermostatHeat && t.Action != protocol.ThermostatCool,
+		t.Failsafe != "" && t.Failsafe != "on" && t.Failsafe != "off",
+		t.Band <= 0,
+		t.MinOn > 3600 || t.MinOff > 3600,
+		time.Duration(t.FailsafeAfter)*time.Second > readingStale,
+		t.Mode == "proportional" && (t.Period < 60 || t.Period > 3600):
+		return errInvalidThermostat
+	}
+	lo, hi, ok := thermostatRange(t.Sensor)
+	if !ok || t.Target < lo || t.Target > hi {
+		return errInvalidThermostat
+	}
+	return nil
+}
+
+func publishConfig() {
+	data, err = json.Marshal(config)
+	if err != nil {
+		println("ERROR MARSHALLING CONFIG", err)
+		return
+	}
+	publishData(configTopic, &data)
+}
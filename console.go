@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"machine"
+	"strconv"
+	"strings"
+)
+
+// consoleLineSize bounds a console line, a whole configuration fits in it.
+const consoleLineSize = ConfigSize
+
+var consoleLine []byte
+
+const consoleHelp = `commands:
+  config                        print the configuration
+  config {"tz":"CET-1CEST"}     merge JSON into the configuration
+  relay <1-4> name <name>       set a relay setting: name, icon,
+  relay <1-4> component light   component (switch, light, fan, valve),
+  relay <1-4> inverted true     inverted or power_on
+  i2c                           scan the I2C bus, print the error counters`
+
+// checkConsole runs the lines typed on the serial console, it never
+// blocks.
+func checkConsole() {
+	for machine.Serial.Buffered() > 0 {
+		b, err := machine.Serial.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case '\r', '\n':
+			if len(consoleLine) > 0 {
+				consoleCommand(strings.TrimSpace(string(consoleLine)))
+				consoleLine = consoleLine[:0]
+			}
+		default:
+			if len(consoleLine) < consoleLineSize {
+				consoleLine = append(consoleLine, b)
+			}
+		}
+	}
+}
+
+func consoleCommand(line string) {
+	cmd, args, _ := strings.Cut(line, " ")
+	var err error
+	switch cmd {
+	case "config":
+		if args != "" {
+			err = setConfig([]byte(args))
+		}
+	case "relay":
+		err = consoleRelay(args)
+	case "i2c":
+		i2cScan()
+		for _, addr := range i2cState.Scan {
+			println("[I2C] 0x" + strconv.FormatInt(int64(addr), 16))
+		}
+		raw, _ := json.Marshal(i2cState)
+		println(string(raw))
+		return
+	default:
+		println(consoleHelp)
+		return
+	}
+	if err != nil {
+		println("[CONSOLE]", err.Error())
+		return
+	}
+	raw, _ := json.Marshal(config)
+	println(string(raw))
+	if connectedMQTT && args != "" {
+		publishConfig()
+	}
+}
+
+// consoleRelay sets one setting of a relay, e.g. "3 name Hutch light".
+func consoleRelay(args string) error {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) != 3 {
+		return errInvalidParams
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 1 || n > len(relay) {
+		return errInvalidParams
+	}
+	var v interface{} = fields[2]
+	switch fields[1] {
+	case "name", "icon", "component", "power_on":
+	case "inverted":
+		v = fields[2] == "true"
+	default:
+		return errInvalidParams
+	}
+	relays := make([]map[string]interface{}, n)
+	relays[n-1] = map[string]interface{}{fields[1]: v}
+	payload, err := json.Marshal(map[string]interface{}{"relays": relays})
+	if err != nil {
+		return err
+	}
+	return setConfig(payload)
+}
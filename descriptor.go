@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+func shortDescriptor() protocol.Device {
+	return protocol.Device{
+		ID:   DeviceID,
+		Name: device.Name,
+	}
+}
+
+// fullDescriptor generates Out and Methods from discoveries and methods,
+// the same tables that drive the Home Assistant discovery and the method
+// calls, so both protocols always describe the same device.
+func fullDescriptor() protocol.Device {
+	d := shortDescriptor()
+	d.Version = Version
+	for _, e := range discoveries {
+		if e.ValueID == "" {
+			continue
+		}
+		d.Out = append(d.Out, protocol.Value{
+			ID:    e.ValueID,
+			Name:  e.Name,
+			Unit:  e.UnitOfMeasurement,
+			Scale: e.Scale,
+		})
+	}
+	for _, m := range methods {
+		d.Methods = append(d.Methods, m.Method)
+	}
+	for _, r := range config.Relays {
+		d.Relays = append(d.Relays, r.Name)
+	}
+	return d
+}
+
+// publishDescriptor announces the device on protocol.DiscoveryTopic and its
+// full descriptor on protocol.DeviceTopic. It runs at connect and whenever
+// something is published on protocol.DiscoveryRequestTopic.
+func publishDescriptor() {
+	data, err = json.Marshal(shortDescriptor())
+	if err != nil {
+		println("[DESCRIPTOR]", err)
+		return
+	}
+	publishData(protocol.DiscoveryTopic, &data)
+
+	data, err = json.Marshal(fullDescriptor())
+	if err != nil {
+		println("[DESCRIPTOR]", err)
+		return
+	}
+	publishData(protocol.DeviceTopic(DeviceID), &data)
+}
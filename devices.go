@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// The I2C devices are probed at boot and again every probeInterval. A
+// missing device is skipped, its readings are left out of the sensor state
+// and the features using it fall back: the schedules and the configuration
+// stay in RAM without EEPROM, and the time is kept from the last SNTP sync
+// without RTC.
+const probeInterval = 5 * time.Minute
+
+var (
+	nextProbe time.Time
+
+	errNoClock = errors.New("no RTC and no time sync")
+)
+
+// probeDevices updates the *Enabled flags, configuring the devices that
+// just appeared.
+func probeDevices() {
+	// main loads the EEPROM after the first probe
+	booting := nextProbe.IsZero()
+	nextProbe = time.Now().Add(probeInterval)
+
+	found := distanceSensor.Connected()
+	if found && !distanceSensorEnabled {
+		distanceSensor.Configure(true)
+	}
+	deviceProbed("VL6180X", &distanceSensorEnabled, found)
+
+	found = temperatureSensor.Connected()
+	if found && !temperatureSensorEnabled {
+		temperatureSensor.Configure()
+	}
+	deviceProbed("BME280", &temperatureSensorEnabled, found)
+
+	_, err := rtc.ReadTime()
+	found = err == nil
+	if found && !rtcEnabled {
+		setupRTC()
+	}
+	deviceProbed("RTC", &rtcEnabled, found)
+	if !rtcEnabled {
+		// the time kept since the last sync, if any
+		rtcTimeValid = timeSynced
+	}
+
+	_, err = eeprom.ReadByte(0)
+	found = err == nil
+	reload := found && !eepromEnabled && !booting
+	deviceProbed("EEPROM", &eepromEnabled, found)
+	if reload {
+		reloadEEPROM()
+	}
+
+	sensorState.Devices = protocol.Devices{
+		BME280:  temperatureSensorEnabled,
+		RTC:     rtcEnabled,
+		EEPROM:  eepromEnabled,
+		VL6180X: distanceSensorEnabled,
+	}
+}
+
+// deviceProbed sets enabled to found, reporting the change.
+func deviceProbed(name string, enabled *bool, found bool) {
+	if *enabled == found {
+		return
+	}
+	*enabled = found
+	if !found {
+		println("[DEVICES]", name, "not found")
+		if connectedMQTT {
+			publishEvent("device_missing", name+" not found", protocol.PriorityWarning,
+				protocol.Param{Name: "device", Type: "string", Value: name})
+		}
+		return
+	}
+	println("[DEVICES]", name, "found")
+	if connectedMQTT {
+		publishEvent("device_found", name+" found", protocol.PriorityInfo,
+			protocol.Param{Name: "device", Type: "string", Value: name})
+	}
+}
+
+// reloadEEPROM reads again everything stored in the EEPROM once it is
+// back, before anything writes it. The changes made in RAM while it was
+// missing are dropped.
+func reloadEEPROM() {
+	if c, ok := readConfig(); ok {
+		applyConfig(c)
+	}
+	loadSchedule()
+	loadRelaySchedule()
+	loadRelayStates()
+	publishConfig()
+	publishSchedule()
+	publishRelaySchedule()
+}
+
+// setupRTC starts the oscillator of the RTC. Until SNTP sets it, it keeps
+// running with a fallback date and rtcTimeValid reports it as not valid,
+// but when the time is already known from a sync.
+func setupRTC() {
+	if !rtc.IsRunning() {
+		if err := rtc.SetRunning(true); err != nil {
+			println("Error configuring RTC")
+		}
+	}
+	if timeSynced {
+		if err := rtc.SetTime(lastSyncUTC.Add(time.Since(lastTimeSync))); err != nil {
+			println("Error setting RTC", err.Error())
+		}
+		rtcTimeValid = true
+		return
+	}
+	rtcTimeValid = rtc.IsTimeValid()
+	if !rtcTimeValid {
+		println("DATE IS NOT VALID")
+		date := time.Date(2023, 05, 14, 15, 49, 07, 0, time.UTC)
+		rtc.SetTime(date)
+	}
+}
+
+// readTime returns the current UTC time from the RTC, or from the last
+// SNTP sync when there is no RTC.
+func readTime() (time.Time, error) {
+	if rtcEnabled {
+		return rtc.ReadTime()
+	}
+	if !timeSynced {
+		return time.Time{}, errNoClock
+	}
+	return lastSyncUTC.Add(time.Since(lastTimeSync)), nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// EEPROM layout, see the Alarm, RelaySchedule, RelayState, Config constants for the details:
+//
+//	0x000-0x031 schedule and log pointer (reserved)
+//	0x032-0x03F free
+//	0x040-0x06F relay schedules (reserved)
+//	0x070-0x08F relay states (reserved)
+//	0x090-0x0FF free
+//	0x100-0x4FF config (reserved)
+//	0x500-0xFFF log (reserved)
+const (
+	EEPROMSize = 4096
+	LogAddress = 0x500
+
+	// maxEEPROMRead bounds the size of a single "gm" reply.
+	maxEEPROMRead = 128
+)
+
+type region struct {
+	name       string
+	start, end int
+}
+
+var reservedRegions = []region{
+	{"schedule", Alarm1, NextRecord + 2},
+	{"relay schedule", RelayScheduleAddress, RelayScheduleAddress + RelayScheduleSize},
+	{"relay states", RelayStateAddress, RelayStateAddress + RelayStateSlots},
+	{"config", ConfigAddress, ConfigAddress + ConfigSize},
+	{"log", LogAddress, EEPROMSize},
+}
+
+var eepromTopic = protocol.EEPROMTopic(DeviceID)
+
+var (
+	errUnauthorized = errors.New("invalid token")
+	errOutOfBounds  = errors.New("out of bounds")
+	errReserved     = errors.New("reserved region")
+)
+
+// reservedRegion returns the reserved region overlapping [start, end).
+func reservedRegion(start, end int) (region, bool) {
+	for _, r := range reservedRegions {
+		if start < r.end && end > r.start {
+			return r, true
+		}
+	}
+	return region{}, false
+}
+
+// authorized checks the token of the commands that write the EEPROM: "sm",
+// the configuration and the schedules. The Home Assistant commands of the
+// relays and thermostats can not carry one, they only switch a relay or
+// change a thermostat within the limits of the configuration, and store
+// the result as a side effect.
+func authorized(token string) bool {
+	return len(CommandToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(CommandToken)) == 1
+}
+
+// setValue returns the value of a protocol.SetRequest received on a "/set"
+// topic, errUnauthorized without the command token.
+func setValue(payload []byte) ([]byte, error) {
+	var req protocol.SetRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if !authorized(req.Token) {
+		return nil, errUnauthorized
+	}
+	return req.Value, nil
+}
+
+// eepromHandler runs the "get" and "set" EEPROM commands.
+func eepromHandler(cmd string, payload []byte) {
+	var req protocol.EEPROMRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		println("[EEPROM]", err.Error())
+		return
+	}
+	var reply protocol.EEPROMReply
+	var err error
+	switch cmd {
+	case "get":
+		reply, err = eepromGet(&req)
+	case "set":
+		reply, err = eepromSet(&req)
+	default:
+		return
+	}
+	if err != nil {
+		println("[EEPROM]", cmd, err.Error())
+		reply = protocol.EEPROMReply{P: req.P, Error: err.Error()}
+	}
+	data, err = json.Marshal(reply)
+	if err != nil {
+		println("ERROR MARSHALLING EEPROM REPLY", err)
+		return
+	}
+	publishData(eepromTopic, &data)
+}
+
+func eepromGet(req *protocol.EEPROMRequest) (protocol.EEPROMReply, error) {
+	if !authorized(req.Token) {
+		return protocol.EEPROMReply{}, errUnauthorized
+	}
+	if !eepromEnabled {
+		return protocol.EEPROMReply{}, errNoEEPROM
+	}
+	if req.N <= 0 || req.N > maxEEPROMRead || req.P < 0 || req.P+req.N > EEPROMSize {
+		return protocol.EEPROMReply{}, errOutOfBounds
+	}
+	buf := make([]byte, req.N)
+	if _, err := eeprom.ReadAt(buf, int64(req.P)); err != nil {
+		return protocol.EEPROMReply{}, err
+	}
+	return protocol.EEPROMReply{P: req.P, Data: buf}, nil
+}
+
+// eepromSet writes the request and reports every attempt, successful or not,
+// as an audit event.
+func eepromSet(req *protocol.EEPROMRequest) (protocol.EEPROMReply, error) {
+	buf := req.Data
+	if req.V != nil {
+		buf = []byte{*req.V}
+	}
+	extra := []protocol.Param{
+		{Name: "p", Type: "int", Value: strconv.Itoa(req.P)},
+		{Name: "n", Type: "int", Value: strconv.Itoa(len(buf))},
+	}
+
+	err := checkEEPROMWrite(req, buf)
+	if err == nil {
+		_, err = eeprom.WriteAt(buf, int64(req.P))
+	}
+	if err != nil {
+		extra = append(extra, protocol.Param{Name: "error", Type: "string", Value: err.Error()})
+		publishEvent("eeprom_write", "EEPROM write rejected", protocol.PriorityWarning, extra...)
+		return protocol.EEPROMReply{}, err
+	}
+	publishEvent("eeprom_write", "EEPROM written", protocol.PriorityInfo, extra...)
+
+	// reload whatever was overwritten
+	for _, r := range reservedRegions {
+		if req.P >= r.end || req.P+len(buf) <= r.start {
+			continue
+		}
+		switch r.name {
+		case "config":
+			loadConfig()
+			publishConfig()
+		case "schedule":
+			loadSchedule()
+			resetSchedule()
+			publishSchedule()
+		}
+	}
+	return protocol.EEPROMReply{P: req.P, Data: buf}, nil
+}
+
+func checkEEPROMWrite(req *protocol.EEPROMRequest, buf []byte) error {
+	if !authorized(req.Token) {
+		return errUnauthorized
+	}
+	if !eepromEnabled {
+		return errNoEEPROM
+	}
+	if len(buf) == 0 || len(buf) > maxEEPROMRead || req.P < 0 || req.P+len(buf) > EEPROMSize {
+		return errOutOfBounds
+	}
+	if _, ok := reservedRegion(req.P, req.P+len(buf)); ok && !req.Force {
+		return errReserved
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+func publishEvent(kind, message string, priority uint8, extra ...protocol.Param) {
+	ev := protocol.Event{
+		ID:       DeviceID,
+		Message:  message,
+		Priority: priority,
+		Extra:    append([]protocol.Param{{Name: "event", Type: "string", Value: kind}}, extra...),
+	}
+	if rtcTimeValid {
+		if now, err := readTime(); err == nil {
+			ev.Time = now.Format(time.RFC3339)
+		}
+	}
+	data, err = json.Marshal(ev)
+	if err != nil {
+		println("ERROR MARSHALLING EVENT", err)
+		return
+	}
+	publishData(protocol.EventsTopic, &data)
+}
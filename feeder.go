@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+const (
+	// stepsPerGram converts a quantity of food to motor steps, it depends
+	// on the auger and the kind of food.
+	stepsPerGram = 20
+	// stepDelay is half the period of the step signal.
+	stepDelay = 2 * time.Millisecond
+)
+
+var (
+	motorRunning bool
+	// pendingFeeding is the quantity asked by a call, fed from the main
+	// loop so the MQTT callback answers at once, 0 when none.
+	pendingFeeding uint32
+)
+
+// feed turns the auger to dispense grams of food and reports it with a
+// "feeding" event, source tells what asked for it.
+func feed(grams uint32, source string) {
+	motorRunning = true
+	interlockMotor()
+	sendMotorStatus()
+
+	dirPin.High()
+	steps := grams * stepsPerGram
+	for i := uint32(0); i < steps; i++ {
+		stepPin.High()
+		time.Sleep(stepDelay)
+		stepPin.Low()
+		time.Sleep(stepDelay)
+	}
+
+	motorRunning = false
+	interlockMotor()
+	sendMotorStatus()
+
+	publishEvent("feeding", "Food dispensed", protocol.PriorityInfo,
+		protocol.Param{Name: "quantity", Type: "int", Value: strconv.Itoa(int(grams))},
+		protocol.Param{Name: "source", Type: "string", Value: source},
+	)
+}
+
+// feedPending dispenses the feeding asked by a call, if any.
+func feedPending() {
+	if grams := pendingFeeding; grams != 0 {
+		pendingFeeding = 0
+		feed(grams, "call")
+	}
+}
+
+func sendMotorStatus() {
+	data = []byte("OFF")
+	if motorRunning {
+		data = []byte("ON")
+	}
+	publishData(motorStateTopic, &data)
+}
+
+// hopperLevel converts the distance from the sensor to the food to a
+// percentage, using the distances measured with an empty and a full hopper.
+func hopperLevel(d uint16) uint8 {
+	empty, full := config.HopperEmpty, config.HopperFull
+	if empty <= full || d >= empty {
+		return 0
+	}
+	if d <= full {
+		return 100
+	}
+	return uint8(uint32(empty-d) * 100 / uint32(empty-full))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"machine"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	"tinygo.org/x/drivers/at24cx"
+	"tinygo.org/x/drivers/bme280"
+	"tinygo.org/x/drivers/ds3231"
+	"tinygo.org/x/drivers/vl6180x"
+)
+
+// i2cBus is machine.I2C0 counting the failed transfers of every device.
+// A timeout means a slave holds the bus, which is recovered right away so
+// the next transfers do not hang as well.
+type i2cBus struct{}
+
+var (
+	i2c      i2cBus
+	i2cState protocol.I2CState
+)
+
+var i2cTopic = protocol.I2CTopic(DeviceID)
+
+func (i2cBus) Tx(addr uint16, w, r []byte) error {
+	return i2cCount(addr, machine.I2C0.Tx(addr, w, r))
+}
+
+func (i2cBus) ReadRegister(addr uint8, reg uint8, buf []byte) error {
+	return i2cCount(uint16(addr), machine.I2C0.ReadRegister(addr, reg, buf))
+}
+
+func (i2cBus) WriteRegister(addr uint8, reg uint8, buf []byte) error {
+	return i2cCount(uint16(addr), machine.I2C0.WriteRegister(addr, reg, buf))
+}
+
+// i2cCount records the result of a transfer with the device at addr.
+func i2cCount(addr uint16, err error) error {
+	if err == nil {
+		return nil
+	}
+	var s *protocol.I2CStats
+	switch addr {
+	case bme280.Address:
+		s = &i2cState.BME280
+	case ds3231.Address:
+		s = &i2cState.RTC
+	case at24cx.Address:
+		s = &i2cState.EEPROM
+	case vl6180x.Address:
+		s = &i2cState.VL6180X
+	}
+	if s != nil {
+		s.Errors++
+	}
+	if i2cTimeout(err) {
+		if s != nil {
+			s.Timeouts++
+		}
+		i2cRecover()
+	}
+	return err
+}
+
+// i2cTimeout tells the errors of a bus that did not answer at all from
+// the NACKs, the machine package does not export them.
+func i2cTimeout(err error) bool {
+	return strings.Contains(err.Error(), "timeout")
+}
+
+// i2cRecover frees a bus held by a slave in the middle of a byte: with
+// SDA released, up to nine clocks on SCL let it shift the byte out, then a
+// STOP resets it and the SERCOM is configured again.
+func i2cRecover() {
+	println("[I2C] bus stuck, recovering")
+	i2cState.Recoveries++
+	scl, sda := machine.SCL_PIN, machine.SDA_PIN
+	sda.Configure(machine.PinConfig{Mode: machine.PinInputPullup})
+	scl.Configure(machine.PinConfig{Mode: machine.PinOutput})
+	scl.High()
+	i2cDelay()
+	for i := 0; i < 9 && !sda.Get(); i++ {
+		scl.Low()
+		i2cDelay()
+		scl.High()
+		i2cDelay()
+	}
+	// STOP: SDA rises while SCL is high
+	scl.Low()
+	sda.Configure(machine.PinConfig{Mode: machine.PinOutput})
+	sda.Low()
+	i2cDelay()
+	scl.High()
+	i2cDelay()
+	sda.High()
+	i2cDelay()
+	machine.I2C0.Configure(machine.I2CConfig{})
+}
+
+// i2cDelay is half a clock period at 100kHz.
+func i2cDelay() {
+	time.Sleep(5 * time.Microsecond)
+}
+
+// i2cScan stores in i2cState the 7-bit addresses that acknowledge a one
+// byte read, the reserved addresses excepted.
+func i2cScan() {
+	i2cState.Scan = []int{}
+	buf := []byte{0}
+	for addr := uint16(0x08); addr < 0x78; addr++ {
+		err := machine.I2C0.Tx(addr, nil, buf)
+		if err == nil {
+			i2cState.Scan = append(i2cState.Scan, int(addr))
+		} else if i2cTimeout(err) {
+			i2cRecover()
+		}
+	}
+	println("[I2C] scan", len(i2cState.Scan), "devices")
+}
+
+func publishI2CState() {
+	data, err = json.Marshal(i2cState)
+	if err != nil {
+		println("ERROR MARSHALLING I2C STATE", err)
+		return
+	}
+	publishData(i2cTopic, &data)
+}
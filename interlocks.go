@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// Interlock rules, a relay is only turned on when every rule holding it
+// allows it.
+const (
+	// InterlockExclusive allows at most one of the relays on.
+	InterlockExclusive = "exclusive"
+	// InterlockMotor only allows the relays on while the motor runs, they
+	// are turned off when it stops.
+	InterlockMotor = "motor"
+	// InterlockNoMotor forbids the relays while the motor runs, they are
+	// turned off before it starts: a feeding is never delayed by a relay.
+	InterlockNoMotor = "no_motor"
+)
+
+// Interlock is a rule of the interlock table, Relays are numbered 1 to 4.
+type Interlock struct {
+	Rule   string `json:"rule"`
+	Relays []int  `json:"relays"`
+}
+
+var (
+	errInvalidInterlock = errors.New("invalid interlock")
+
+	errInterlockExclusive = errors.New("interlock: another relay of the group is on")
+	errInterlockMotor     = errors.New("interlock: the motor is not running")
+	errInterlockNoMotor   = errors.New("interlock: the motor is running")
+)
+
+func (l *Interlock) holds(i int) bool {
+	for _, n := range l.Relays {
+		if n == i+1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Interlock) validate() error {
+	if l.Rule != InterlockExclusive && l.Rule != InterlockMotor && l.Rule != InterlockNoMotor {
+		return errInvalidInterlock
+	}
+	if len(l.Relays) == 0 || l.Rule == InterlockExclusive && len(l.Relays) < 2 {
+		return errInvalidInterlock
+	}
+	var seen [5]bool
+	for _, n := range l.Relays {
+		if !relayNumber(n) || seen[n] {
+			return errInvalidInterlock
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
+// relayNumber tells whether n, from the configuration, is a relay: 1 to 4.
+func relayNumber(n int) bool {
+	return n >= 1 && n <= len(relay)
+}
+
+// interlocked returns why the relay i can not be turned on, nil when it
+// can.
+func interlocked(i int) error {
+	for _, l := range config.Interlocks {
+		if !l.holds(i) {
+			continue
+		}
+		switch l.Rule {
+		case InterlockExclusive:
+			for _, n := range l.Relays {
+				if n != i+1 && relayNumber(n) && relayOn(n-1) {
+					return errInterlockExclusive
+				}
+			}
+		case InterlockMotor:
+			if !motorRunning {
+				return errInterlockMotor
+			}
+		case InterlockNoMotor:
+			if motorRunning {
+				return errInterlockNoMotor
+			}
+		}
+	}
+	return nil
+}
+
+// interlockRejected reports a command refused by the interlocks, or a
+// scheduled event refused by the thermostat of the relay, with an error
+// event.
+func interlockRejected(i int, command string, err error) {
+	println("[RELAY]", i+1, command, err.Error())
+	publishEvent("relay_rejected", "Relay command rejected", protocol.PriorityWarning,
+		protocol.Param{Name: "relay", Type: "int", Value: strconv.Itoa(i + 1)},
+		protocol.Param{Name: "command", Type: "string", Value: command},
+		protocol.Param{Name: "reason", Type: "string", Value: err.Error()},
+	)
+}
+
+// interlockMotor turns off the relays the motor state, just changed,
+// forbids.
+func interlockMotor() {
+	rule := InterlockMotor
+	if motorRunning {
+		rule = InterlockNoMotor
+	}
+	changed := false
+	for _, l := range config.Interlocks {
+		if l.Rule != rule {
+			continue
+		}
+		for _, n := range l.Relays {
+			if relayNumber(n) && relayOn(n-1) {
+				println("[RELAY]", n, "off, interlocked with the motor")
+				relayUntil[n-1] = time.Time{}
+				setRelay(n-1, false)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		sendRelayStatus()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"machine"
 	"time"
 
+	"github.com/conejoninja/rabbit-feeder/protocol"
 	"tinygo.org/x/drivers/at24cx"
 	"tinygo.org/x/drivers/wifinina"
 
@@ -31,8 +32,13 @@ var (
 	rtcEnabled               bool
 	eepromEnabled            bool
 
-	sensorState SensorState
-	relayState  RelayState
+	// rtcTimeValid is false while the RTC holds the fallback date written
+	// at boot instead of a real time, or without RTC until SNTP sets the
+	// time.
+	rtcTimeValid bool
+
+	sensorState protocol.SensorState
+	relayState  protocol.RelayState
 	data        []byte
 	err         error
 
@@ -50,8 +56,8 @@ const (
 	Quantity1  = 20
 	Alarm2     = 24
 	LastAlarm2 = 28
-	NextAlarm3 = 36
-	Quantity4  = 44
+	NextAlarm2 = 36
+	Quantity2  = 44
 	NextRecord = 48
 )
 
@@ -77,10 +83,8 @@ func main() {
 		machine.D3,
 		machine.D2,
 	}
-	for i := 0; i < 4; i++ {
-		relay[i].Configure(machine.PinConfig{Mode: machine.PinOutput})
-		relay[i].Low()
-	}
+	// the pins stay inputs until powerOnRelays knows which boards are
+	// inverted
 
 	// SETUP THE MOTOR
 	dirPin = machine.D10
@@ -93,45 +97,22 @@ func main() {
 
 	machine.I2C0.Configure(machine.I2CConfig{})
 
-	// SETUP DISTANCE SENSOR
-	distanceSensor = vl6180x.New(machine.I2C0)
-	distanceSensorEnabled = distanceSensor.Connected()
-	if !distanceSensorEnabled {
-		println("VL6180X device not found")
-	} else {
-		distanceSensor.Configure(true)
-	}
-
-	// SETUP BME280
-	temperatureSensor = bme280.New(machine.I2C0)
-	temperatureSensor.Configure()
-
-	// SETUP RTC
-	rtc = ds3231.New(machine.I2C0)
+	// SETUP THE I2C DEVICES, the missing ones are probed again later. They
+	// share the bus through i2c, which counts their errors.
+	distanceSensor = vl6180x.New(i2c)
+	temperatureSensor = bme280.New(i2c)
+	rtc = ds3231.New(i2c)
 	rtc.Configure()
-
-	valid := rtc.IsTimeValid()
-	if !valid {
-		println("DATE IS NOT VALID")
-		date := time.Date(2023, 05, 14, 15, 49, 07, 0, time.UTC)
-		rtc.SetTime(date)
-	}
-
-	rtcEnabled = rtc.IsRunning()
-	if !rtcEnabled {
-		err := rtc.SetRunning(true)
-		if err != nil {
-			println("Error configuring RTC")
-		} else {
-			rtcEnabled = true
-		}
-	}
-
-	// SETUP EEPROM
-	eeprom := at24cx.New(machine.I2C0)
+	eeprom = at24cx.New(i2c)
 	eeprom.Configure(at24cx.Config{})
-	eepromEnabled = true // assume it's working
 	eepromData = make([]byte, 48)
+	probeDevices()
+
+	loadConfig()
+	loadSchedule()
+	loadRelaySchedule()
+	loadRelayStates()
+	powerOnRelays()
 
 	// Configure SPI for 8Mhz, Mode 0, MSB First
 	spi.Configure(machine.SPIConfig{
@@ -150,54 +131,141 @@ func main() {
 	adaptor.Configure()
 
 	connectToAP()
+	if err := syncTime(); err != nil {
+		println("[NTP]", err.Error())
+	}
 	connectToMQTT()
+	// the relays may be on since powerOnRelays
+	sendRelayStatus()
 	publishDiscovery()
+	publishDescriptor()
+	publishConfig()
+	publishSchedule()
+	publishRelaySchedule()
 	// Let discovery message to be processed and other devices subscribe to it
 	time.Sleep(2 * time.Second)
 
+	// The relay timers are checked every relayTick, the rest runs every
+	// minute.
+	var next time.Time
 	for {
+		now := time.Now()
+		checkRelayTimers(now)
+		checkThermostats(now)
+		saveRelayStates(now)
+		checkConsole()
+		feedPending()
+		if now.Before(next) {
+			time.Sleep(relayTick)
+			continue
+		}
+		next = now.Add(time.Second * 60)
+
+		if timeSyncDue() {
+			resyncTime()
+		}
 
+		if !now.Before(nextProbe) {
+			probeDevices()
+		}
+		checkSchedule()
+		checkRelaySchedule()
 		sendSensorStatus()
 		sendRelayStatus()
-
-		time.Sleep(time.Second * 60)
+		publishThermostats()
+		publishI2CState()
 	}
 }
 
 func sendSensorStatus() {
-	distance = distanceSensor.Read()
-	println("Distance:", distance)
-	sensorState.Distance = distance
+	sensorState.Schema = protocol.SchemaVersion
+
+	now := time.Now()
+	sensorState.Distance = nil
+	sensorState.Level = nil
+	if distanceSensorEnabled {
+		// the driver hides the bus errors, i2c counts them
+		errs := i2cState.VL6180X.Errors
+		distance = distanceSensor.Read()
+		err = nil
+		if status := distanceSensor.ReadStatus(); status != 0 || i2cState.VL6180X.Errors != errs {
+			println("Error reading distance, status", status)
+			err = errDistance
+		}
+		println("Distance:", distance)
+		distanceReading.update(int32(distance), err, now)
+		if v := distanceReading.last(now); v != nil {
+			d := uint16(*v)
+			level := hopperLevel(d)
+			sensorState.Distance = &d
+			sensorState.Level = &level
+		}
+	} else {
+		distanceReading.age(now)
+	}
 
-	dt, err = rtc.ReadTime()
+	sensorState.Timestamp = ""
+	sensorState.RTCDrift = nil
+	dt, err = readTime()
 	if err != nil {
 		println("Error reading date:", err)
 	} else {
 		println(dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second())
+		sensorState.Timestamp = dt.Format(time.RFC3339)
+		if now, ok := networkTime(); ok && rtcEnabled {
+			drift := int32(dt.Sub(now) / time.Second)
+			println("RTC drift:", drift)
+			sensorState.RTCDrift = &drift
+		}
+	}
+	sensorState.TimeValid = rtcTimeValid
+	if timeSynced {
+		sensorState.LastSync = lastSyncUTC.Format(time.RFC3339)
 	}
-	sensorState.Date = dt.Format(time.RFC3339)
+	sensorState.SyncDrift = syncDrift
+	sensorState.DriftRate = driftRate
 
 	/*temp, _ = rtc.ReadTemperature()
 	println("Temperature (RTC):", temp)
 	sensorState.Temperature = temp*/
 
-	temp, _ = temperatureSensor.ReadTemperature()
-	println("Temperature (BME280):", temp)
-	sensorState.Temperature = temp
-	temp, _ = temperatureSensor.ReadPressure()
-	println("Pressure (BME280):", temp)
-	sensorState.Pressure = temp
-	temp, _ = temperatureSensor.ReadHumidity()
-	println("Humidity (BME280):", temp)
-	sensorState.Humidity = temp
-
-	n, err = eeprom.Read(eepromData)
-	println(n, err)
-	for i := 0; i < 48; i++ {
-		print(eepromData[i])
+	sensorState.Temperature = nil
+	sensorState.Pressure = nil
+	sensorState.Humidity = nil
+	environmentValid = false
+	if temperatureSensorEnabled {
+		temp, err = temperatureSensor.ReadTemperature()
+		println("Temperature (BME280):", temp)
+		environmentValid = temperatureReading.update(temp, err, now)
+		temp, err = temperatureSensor.ReadPressure()
+		println("Pressure (BME280):", temp)
+		pressureReading.update(temp, err, now)
+		temp, err = temperatureSensor.ReadHumidity()
+		println("Humidity (BME280):", temp)
+		environmentValid = humidityReading.update(temp, err, now) && environmentValid
+		sensorState.Temperature = temperatureReading.last(now)
+		sensorState.Pressure = pressureReading.last(now)
+		sensorState.Humidity = humidityReading.last(now)
+	} else {
+		temperatureReading.age(now)
+		pressureReading.age(now)
+		humidityReading.age(now)
+	}
+	checkWelfare()
+
+	sensorState.EEPROM = nil
+	if eepromEnabled {
+		n, err = eeprom.ReadAt(eepromData, Alarm1)
+		if err != nil {
+			println("Error reading EEPROM:", err.Error())
+		} else {
+			for i := 0; i < n; i++ {
+				print(eepromData[i])
+			}
+			println("==========")
+			sensorState.EEPROM = eepromData
+		}
 	}
-	println("==========")
-	sensorState.EEPROM = eepromData
 
 	data, err = json.Marshal(sensorState)
 	if err != nil {
@@ -208,26 +276,40 @@ func sendSensorStatus() {
 }
 
 func sendRelayStatus() {
+	readRelayState()
+	data, err = json.Marshal(relayState)
+	if err != nil {
+		println("ERROR MARSHALLING RELAY DATA", err)
+	} else {
+		publishData(relayStateTopic, &data)
+	}
+}
+
+// readRelayState updates relayState from the relay pins, timers and
+// schedule overrides.
+func readRelayState() {
 	relayState.Relay1 = "OFF"
 	relayState.Relay2 = "OFF"
 	relayState.Relay3 = "OFF"
 	relayState.Relay4 = "OFF"
-	if relay[0].Get() {
+	if relayOn(0) {
 		relayState.Relay1 = "ON"
 	}
-	if relay[1].Get() {
+	if relayOn(1) {
 		relayState.Relay2 = "ON"
 	}
-	if relay[2].Get() {
+	if relayOn(2) {
 		relayState.Relay3 = "ON"
 	}
-	if relay[3].Get() {
+	if relayOn(3) {
 		relayState.Relay4 = "ON"
 	}
-	data, err = json.Marshal(relayState)
-	if err != nil {
-		println("ERROR MARSHALLING RELAY DATA", err)
-	} else {
-		publishData(relayStateTopic, &data)
-	}
+	relayState.Timer1 = relayTimer(0)
+	relayState.Timer2 = relayTimer(1)
+	relayState.Timer3 = relayTimer(2)
+	relayState.Timer4 = relayTimer(3)
+	relayState.Override1 = relayOverride[0]
+	relayState.Override2 = relayOverride[1]
+	relayState.Override3 = relayOverride[2]
+	relayState.Override4 = relayOverride[3]
 }
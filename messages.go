@@ -1,7 +1,16 @@
 package main
 
+import (
+	"strconv"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
 const DeviceID = "rabbitf3"
 
+// Version of the firmware, reported by the "info" method.
+const Version = "v1.1.0"
+
 type Discovery struct {
 	Home              string `json:"~"`
 	Name              string `json:"name,omitempty"`
@@ -11,8 +20,27 @@ type Discovery struct {
 	ValueTemplate     string `json:"value_template,omitempty"`
 	CommandTopic      string `json:"cmd_t,omitempty"`
 	StatusTopic       string `json:"stat_t,omitempty"`
+	DeviceClass       string `json:"device_class,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+	EntityCategory    string `json:"entity_category,omitempty"`
 	Device            Device `json:"device,omitempty"`
 	Icon              string `json:"icon,omitempty"`
+
+	// The relays announced as lights and fans read their state with
+	// StateValueTemplate, the valves map open and closed to ON and OFF.
+	StateValueTemplate string `json:"state_value_template,omitempty"`
+	PayloadOpen        string `json:"payload_open,omitempty"`
+	PayloadClose       string `json:"payload_close,omitempty"`
+	StateOpen          string `json:"state_open,omitempty"`
+	StateClosed        string `json:"state_closed,omitempty"`
+
+	// Options are the states of an enum sensor.
+	Options []string `json:"options,omitempty"`
+
+	// ValueID is the short ID of the entity in the device descriptor, it
+	// is not announced there when empty. Scale is its fixed-point scale.
+	ValueID string `json:"-"`
+	Scale   int    `json:"-"`
 }
 
 type Device struct {
@@ -22,21 +50,11 @@ type Device struct {
 	Manufacturer string   `json:"manufacturer,omitempty"`
 }
 
-type SensorState struct {
-	Temperature int32  `json:"temperature,omitempty"`
-	Humidity    int32  `json:"humidity,omitempty"`
-	Pressure    int32  `json:"pressure,omitempty"`
-	Distance    uint16 `json:"distance,omitempty"`
-	EEPROM      []byte `json:"eeprom,omitempty"`
-	Date        string `json:"date,omitempty"`
-}
-
-type RelayState struct {
-	Relay1 string `json:"relay1,omitempty"`
-	Relay2 string `json:"relay2,omitempty"`
-	Relay3 string `json:"relay3,omitempty"`
-	Relay4 string `json:"relay4,omitempty"`
-}
+var (
+	sensorStateTopic = protocol.SensorStateTopic(DeviceID)
+	relayStateTopic  = protocol.RelayStateTopic(DeviceID)
+	motorStateTopic  = protocol.MotorStateTopic(DeviceID)
+)
 
 var device = Device{
 	Identifiers:  []string{"rabbitf3"},
@@ -45,52 +63,51 @@ var device = Device{
 	Manufacturer: "@conejo@social.tinygo.org",
 }
 
-var Relay1Discovery = Discovery{
-	Home:          "homeassistant/switch/relay1",
-	Name:          "Relay 1 (USB)",
-	UniqueID:      DeviceID + "_relay1",
-	ObjectID:      DeviceID + "_relay1",
-	ValueTemplate: "{{ value_json.relay1 }}",
-	CommandTopic:  "~/set",
-	StatusTopic:   "homeassistant/switch/relays/state",
-	Device:        device,
-	Icon:          "mdi:usb-port",
-}
+// relayComponents are the Home Assistant entities a relay can be.
+var relayComponents = []string{"switch", "light", "fan", "valve"}
 
-var Relay2Discovery = Discovery{
-	Home:          "homeassistant/switch/relay2",
-	Name:          "Relay 2 (USB)",
-	UniqueID:      DeviceID + "_relay2",
-	ObjectID:      DeviceID + "_relay2",
-	ValueTemplate: "{{ value_json.relay2 }}",
-	CommandTopic:  "~/set",
-	StatusTopic:   "homeassistant/switch/relays/state",
-	Device:        device,
-	Icon:          "mdi:usb-port",
+func relayComponent(c string) bool {
+	for _, rc := range relayComponents {
+		if c == rc {
+			return true
+		}
+	}
+	return false
 }
 
-var Relay3Discovery = Discovery{
-	Home:          "homeassistant/switch/relay3",
-	Name:          "Relay 3 (12V)",
-	UniqueID:      DeviceID + "_relay3",
-	ObjectID:      DeviceID + "_relay3",
-	ValueTemplate: "{{ value_json.relay3 }}",
-	CommandTopic:  "~/set",
-	StatusTopic:   "homeassistant/switch/relays/state",
-	Device:        device,
-	Icon:          "mdi:audio-input-stereo-minijack",
+// relayDiscovery returns the entity of the relay n, 1 to 4, from its
+// settings. The relay command payloads and state values are always "ON"
+// and "OFF".
+func relayDiscovery(n int, r *RelayConfig) Discovery {
+	id := "relay" + strconv.Itoa(n)
+	d := Discovery{
+		Home:         relayHome(n, r.Component),
+		Name:         r.Name,
+		UniqueID:     DeviceID + "_" + id,
+		ObjectID:     DeviceID + "_" + id,
+		CommandTopic: "~/set",
+		StatusTopic:  relayStateTopic,
+		Device:       device,
+		Icon:         r.Icon,
+	}
+	template := "{{ value_json." + id + " }}"
+	switch r.Component {
+	case "light", "fan":
+		d.StateValueTemplate = template
+	case "valve":
+		d.ValueTemplate = template
+		d.PayloadOpen, d.PayloadClose = protocol.RelayOn, protocol.RelayOff
+		d.StateOpen, d.StateClosed = protocol.RelayOn, protocol.RelayOff
+	default:
+		d.ValueTemplate = template
+	}
+	return d
 }
 
-var Relay4Discovery = Discovery{
-	Home:          "homeassistant/switch/relay4",
-	Name:          "Relay 4 (12V)",
-	UniqueID:      DeviceID + "_relay4",
-	ObjectID:      DeviceID + "_relay4",
-	ValueTemplate: "{{ value_json.relay4 }}",
-	CommandTopic:  "~/set",
-	StatusTopic:   "homeassistant/switch/relays/state",
-	Device:        device,
-	Icon:          "mdi:audio-input-stereo-minijack",
+// relayHome is the discovery prefix of the relay n, its command topic is
+// relayHome + "/set".
+func relayHome(n int, component string) string {
+	return "homeassistant/" + component + "/relay" + strconv.Itoa(n)
 }
 
 var TemperatureDiscovery = Discovery{
@@ -98,11 +115,15 @@ var TemperatureDiscovery = Discovery{
 	Name:              "Temperature",
 	UniqueID:          DeviceID + "_temp",
 	ObjectID:          DeviceID + "_temp",
-	UnitOfMeasurement: "ºC",
-	ValueTemplate:     "{{ value_json.temperature / 1000 }}",
-	StatusTopic:       "homeassistant/switch/sensors/state",
+	UnitOfMeasurement: protocol.TemperatureUnit,
+	ValueTemplate:     protocol.ValueTemplate("temperature", protocol.TemperatureScale),
+	StatusTopic:       sensorStateTopic,
+	DeviceClass:       "temperature",
+	StateClass:        "measurement",
 	Device:            device,
 	Icon:              "mdi:thermometer",
+	ValueID:           "t",
+	Scale:             protocol.TemperatureScale,
 }
 
 var HumidityDiscovery = Discovery{
@@ -110,11 +131,15 @@ var HumidityDiscovery = Discovery{
 	Name:              "Humidity",
 	UniqueID:          DeviceID + "_humidity",
 	ObjectID:          DeviceID + "_humidity",
-	UnitOfMeasurement: "%",
-	ValueTemplate:     "{{ value_json.humidity / 100 }}",
-	StatusTopic:       "homeassistant/switch/sensors/state",
+	UnitOfMeasurement: protocol.HumidityUnit,
+	ValueTemplate:     protocol.ValueTemplate("humidity", protocol.HumidityScale),
+	StatusTopic:       sensorStateTopic,
+	DeviceClass:       "humidity",
+	StateClass:        "measurement",
 	Device:            device,
 	Icon:              "mdi:water-percent",
+	ValueID:           "h",
+	Scale:             protocol.HumidityScale,
 }
 
 var PressureDiscovery = Discovery{
@@ -122,11 +147,75 @@ var PressureDiscovery = Discovery{
 	Name:              "Pressure",
 	UniqueID:          DeviceID + "_pressure",
 	ObjectID:          DeviceID + "_pressure",
-	UnitOfMeasurement: "Pa",
-	ValueTemplate:     "{{ value_json.pressure / 1000 }}",
-	StatusTopic:       "homeassistant/switch/sensors/state",
+	UnitOfMeasurement: protocol.PressureUnit,
+	ValueTemplate:     protocol.ValueTemplate("pressure", protocol.PressureScale),
+	StatusTopic:       sensorStateTopic,
+	DeviceClass:       "pressure",
+	StateClass:        "measurement",
 	Device:            device,
 	Icon:              "mdi:air-filter",
+	ValueID:           "p",
+	Scale:             protocol.PressureScale,
+}
+
+var DewPointDiscovery = Discovery{
+	Home:              "homeassistant/sensor/dew_point",
+	Name:              "Dew point",
+	UniqueID:          DeviceID + "_dew_point",
+	ObjectID:          DeviceID + "_dew_point",
+	UnitOfMeasurement: protocol.TemperatureUnit,
+	ValueTemplate:     protocol.ValueTemplate("dew_point", protocol.TemperatureScale),
+	StatusTopic:       sensorStateTopic,
+	DeviceClass:       "temperature",
+	StateClass:        "measurement",
+	Device:            device,
+	Icon:              "mdi:water-thermometer",
+	ValueID:           "dp",
+	Scale:             protocol.TemperatureScale,
+}
+
+var AbsoluteHumidityDiscovery = Discovery{
+	Home:              "homeassistant/sensor/absolute_humidity",
+	Name:              "Absolute humidity",
+	UniqueID:          DeviceID + "_absolute_humidity",
+	ObjectID:          DeviceID + "_absolute_humidity",
+	UnitOfMeasurement: protocol.AbsoluteHumidityUnit,
+	ValueTemplate:     protocol.ValueTemplate("absolute_humidity", protocol.AbsoluteHumidityScale),
+	StatusTopic:       sensorStateTopic,
+	DeviceClass:       "absolute_humidity",
+	StateClass:        "measurement",
+	Device:            device,
+	Icon:              "mdi:water",
+	ValueID:           "ah",
+	Scale:             protocol.AbsoluteHumidityScale,
+}
+
+var HeatStressDiscovery = Discovery{
+	Home:          "homeassistant/sensor/heat_stress",
+	Name:          "Heat stress index",
+	UniqueID:      DeviceID + "_heat_stress",
+	ObjectID:      DeviceID + "_heat_stress",
+	ValueTemplate: protocol.ValueTemplate("heat_stress", protocol.HeatStressScale),
+	StatusTopic:   sensorStateTopic,
+	StateClass:    "measurement",
+	Device:        device,
+	Icon:          "mdi:sun-thermometer",
+	ValueID:       "thi",
+	Scale:         protocol.HeatStressScale,
+}
+
+var WelfareDiscovery = Discovery{
+	Home:          "homeassistant/sensor/welfare",
+	Name:          "Welfare",
+	UniqueID:      DeviceID + "_welfare",
+	ObjectID:      DeviceID + "_welfare",
+	ValueTemplate: "{{ value_json.welfare }}",
+	StatusTopic:   sensorStateTopic,
+	DeviceClass:   "enum",
+	Options:       []string{protocol.WelfareOK, protocol.WelfareWarm, protocol.WelfareDangerous},
+	Device:        device,
+	Icon:          "mdi:rabbit",
+	ValueID:       "w",
 }
 
 var DistanceDiscovery = Discovery{
@@ -134,22 +223,93 @@ var DistanceDiscovery = Discovery{
 	Name:              "Distance",
 	UniqueID:          DeviceID + "_dist",
 	ObjectID:          DeviceID + "_dist",
-	UnitOfMeasurement: "mm",
-	ValueTemplate:     "{{ value_json.distance }}",
-	StatusTopic:       "homeassistant/switch/sensors/state",
+	UnitOfMeasurement: protocol.DistanceUnit,
+	ValueTemplate:     protocol.ValueTemplate("distance", protocol.DistanceScale),
+	StatusTopic:       sensorStateTopic,
 	Device:            device,
 	Icon:              "mdi:gauge-full",
+	ValueID:           "cr",
+	Scale:             protocol.DistanceScale,
+}
+
+var LevelDiscovery = Discovery{
+	Home:              "homeassistant/sensor/level",
+	Name:              "Hopper level",
+	UniqueID:          DeviceID + "_level",
+	ObjectID:          DeviceID + "_level",
+	UnitOfMeasurement: "%",
+	ValueTemplate:     protocol.ValueTemplate("level", 1),
+	StatusTopic:       sensorStateTopic,
+	StateClass:        "measurement",
+	Device:            device,
+	Icon:              "mdi:gauge",
+	ValueID:           "c",
 }
 
 var RTCDiscovery = Discovery{
-	Home:          "homeassistant/statestream/rtc",
+	Home:          "homeassistant/sensor/rtc",
 	Name:          "RTC",
 	UniqueID:      DeviceID + "_rtc",
 	ObjectID:      DeviceID + "_rtc",
 	ValueTemplate: "{{ value_json.timestamp }}",
-	StatusTopic:   "homeassistant/switch/sensors/state",
+	StatusTopic:   sensorStateTopic,
+	DeviceClass:   "timestamp",
 	Device:        device,
 	Icon:          "mdi:clock-digital",
+	ValueID:       "rtc",
+}
+
+var RTCDriftDiscovery = Discovery{
+	Home:              "homeassistant/sensor/rtc_drift",
+	Name:              "RTC drift",
+	UniqueID:          DeviceID + "_rtc_drift",
+	ObjectID:          DeviceID + "_rtc_drift",
+	UnitOfMeasurement: "s",
+	ValueTemplate:     "{{ value_json.rtc_drift }}",
+	StatusTopic:       sensorStateTopic,
+	StateClass:        "measurement",
+	EntityCategory:    "diagnostic",
+	Device:            device,
+	Icon:              "mdi:clock-alert-outline",
+}
+
+var SyncDriftDiscovery = Discovery{
+	Home:              "homeassistant/sensor/sync_drift",
+	Name:              "RTC drift at last sync",
+	UniqueID:          DeviceID + "_sync_drift",
+	ObjectID:          DeviceID + "_sync_drift",
+	UnitOfMeasurement: "s",
+	ValueTemplate:     "{{ value_json.sync_drift }}",
+	StatusTopic:       sensorStateTopic,
+	StateClass:        "measurement",
+	EntityCategory:    "diagnostic",
+	Device:            device,
+	Icon:              "mdi:clock-alert-outline",
+}
+
+var LastSyncDiscovery = Discovery{
+	Home:           "homeassistant/sensor/last_sync",
+	Name:           "Last time sync",
+	UniqueID:       DeviceID + "_last_sync",
+	ObjectID:       DeviceID + "_last_sync",
+	ValueTemplate:  "{{ value_json.last_sync }}",
+	StatusTopic:    sensorStateTopic,
+	DeviceClass:    "timestamp",
+	EntityCategory: "diagnostic",
+	Device:         device,
+	Icon:           "mdi:clock-check-outline",
+}
+
+var TimeValidDiscovery = Discovery{
+	Home:           "homeassistant/binary_sensor/time_valid",
+	Name:           "RTC time valid",
+	UniqueID:       DeviceID + "_time_valid",
+	ObjectID:       DeviceID + "_time_valid",
+	ValueTemplate:  "{{ 'ON' if value_json.time_valid else 'OFF' }}",
+	StatusTopic:    sensorStateTopic,
+	EntityCategory: "diagnostic",
+	Device:         device,
+	Icon:           "mdi:clock-check-outline",
 }
 
 var EEPROMDiscovery = Discovery{
@@ -158,9 +318,94 @@ var EEPROMDiscovery = Discovery{
 	UniqueID:      DeviceID + "_eeprom",
 	ObjectID:      DeviceID + "_eeprom",
 	ValueTemplate: "{{ value_json.eeprom }}",
-	StatusTopic:   "homeassistant/switch/sensors/state",
+	StatusTopic:   sensorStateTopic,
 	Device:        device,
 	Icon:          "mdi:text-box",
+	ValueID:       "m",
+}
+
+// problemDiscovery returns the diagnostic entity that is on while the I2C
+// device id, a field of protocol.Devices, is missing.
+func problemDiscovery(id, name string) Discovery {
+	return Discovery{
+		Home:           "homeassistant/binary_sensor/" + id + "_problem",
+		Name:           name,
+		UniqueID:       DeviceID + "_" + id + "_problem",
+		ObjectID:       DeviceID + "_" + id + "_problem",
+		ValueTemplate:  "{{ 'OFF' if value_json.devices." + id + " else 'ON' }}",
+		StatusTopic:    sensorStateTopic,
+		DeviceClass:    "problem",
+		EntityCategory: "diagnostic",
+		Device:         device,
+	}
+}
+
+var (
+	BME280ProblemDiscovery  = problemDiscovery("bme280", "BME280")
+	RTCProblemDiscovery     = problemDiscovery("rtc", "RTC")
+	EEPROMProblemDiscovery  = problemDiscovery("eeprom", "EEPROM")
+	VL6180XProblemDiscovery = problemDiscovery("vl6180x", "VL6180X")
+)
+
+// i2cErrorsDiscovery returns the diagnostic entity counting the failed I2C
+// transfers with the device id, a field of protocol.I2CState.
+func i2cErrorsDiscovery(id, name string) Discovery {
+	return Discovery{
+		Home:           "homeassistant/sensor/" + id + "_i2c_errors",
+		Name:           name + " I2C errors",
+		UniqueID:       DeviceID + "_" + id + "_i2c_errors",
+		ObjectID:       DeviceID + "_" + id + "_i2c_errors",
+		ValueTemplate:  "{{ value_json." + id + ".errors }}",
+		StatusTopic:    i2cTopic,
+		StateClass:     "total_increasing",
+		EntityCategory: "diagnostic",
+		Device:         device,
+		Icon:           "mdi:alert-circle-outline",
+	}
+}
+
+var (
+	BME280ErrorsDiscovery  = i2cErrorsDiscovery("bme280", "BME280")
+	RTCErrorsDiscovery     = i2cErrorsDiscovery("rtc", "RTC")
+	EEPROMErrorsDiscovery  = i2cErrorsDiscovery("eeprom", "EEPROM")
+	VL6180XErrorsDiscovery = i2cErrorsDiscovery("vl6180x", "VL6180X")
+)
+
+// readErrorsDiscovery returns the diagnostic entity counting the failed
+// reads of the reading id, a field of protocol.Readings.
+func readErrorsDiscovery(id, name string) Discovery {
+	return Discovery{
+		Home:           "homeassistant/sensor/" + id + "_read_errors",
+		Name:           name + " read errors",
+		UniqueID:       DeviceID + "_" + id + "_read_errors",
+		ObjectID:       DeviceID + "_" + id + "_read_errors",
+		ValueTemplate:  "{{ value_json.readings." + id + ".errors }}",
+		StatusTopic:    sensorStateTopic,
+		StateClass:     "total_increasing",
+		EntityCategory: "diagnostic",
+		Device:         device,
+		Icon:           "mdi:alert-circle-outline",
+	}
+}
+
+var (
+	TemperatureErrorsDiscovery = readErrorsDiscovery("temperature", "Temperature")
+	HumidityErrorsDiscovery    = readErrorsDiscovery("humidity", "Humidity")
+	PressureErrorsDiscovery    = readErrorsDiscovery("pressure", "Pressure")
+	DistanceErrorsDiscovery    = readErrorsDiscovery("distance", "Distance")
+)
+
+var I2CRecoveriesDiscovery = Discovery{
+	Home:           "homeassistant/sensor/i2c_recoveries",
+	Name:           "I2C bus recoveries",
+	UniqueID:       DeviceID + "_i2c_recoveries",
+	ObjectID:       DeviceID + "_i2c_recoveries",
+	ValueTemplate:  "{{ value_json.recoveries }}",
+	StatusTopic:    i2cTopic,
+	StateClass:     "total_increasing",
+	EntityCategory: "diagnostic",
+	Device:         device,
+	Icon:           "mdi:restart-alert",
 }
 
 var MotorDiscovery = Discovery{
@@ -169,7 +414,115 @@ var MotorDiscovery = Discovery{
 	UniqueID:     DeviceID + "_motor",
 	ObjectID:     DeviceID + "_motor",
 	CommandTopic: "~/set",
-	StatusTopic:  "~/state",
+	StatusTopic:  motorStateTopic,
 	Device:       device,
 	Icon:         "mdi:engine",
 }
+
+// discoveries lists every entity announced to Home Assistant, but the
+// relays and thermostats generated from the configuration.
+var discoveries = []*Discovery{
+	&TemperatureDiscovery,
+	&PressureDiscovery,
+	&HumidityDiscovery,
+	&DewPointDiscovery,
+	&AbsoluteHumidityDiscovery,
+	&HeatStressDiscovery,
+	&WelfareDiscovery,
+	&LevelDiscovery,
+	&DistanceDiscovery,
+	&EEPROMDiscovery,
+	&RTCDiscovery,
+	&RTCDriftDiscovery,
+	&SyncDriftDiscovery,
+	&LastSyncDiscovery,
+	&TimeValidDiscovery,
+	&BME280ProblemDiscovery,
+	&RTCProblemDiscovery,
+	&EEPROMProblemDiscovery,
+	&VL6180XProblemDiscovery,
+	&BME280ErrorsDiscovery,
+	&RTCErrorsDiscovery,
+	&EEPROMErrorsDiscovery,
+	&VL6180XErrorsDiscovery,
+	&I2CRecoveriesDiscovery,
+	&TemperatureErrorsDiscovery,
+	&HumidityErrorsDiscovery,
+	&PressureErrorsDiscovery,
+	&DistanceErrorsDiscovery,
+	&MotorDiscovery,
+}
+
+// ClimateDiscovery announces the thermostat of a relay as a Home Assistant
+// climate entity. The temperature or the humidity fields are used,
+// depending on the sensor of the thermostat.
+type ClimateDiscovery struct {
+	Home              string   `json:"~"`
+	Name              string   `json:"name,omitempty"`
+	UniqueID          string   `json:"unique_id,omitempty"`
+	ObjectID          string   `json:"object_id,omitempty"`
+	Modes             []string `json:"modes"`
+	ModeCommandTopic  string   `json:"mode_command_topic"`
+	ModeStateTopic    string   `json:"mode_state_topic"`
+	ModeStateTemplate string   `json:"mode_state_template"`
+	ActionTopic       string   `json:"action_topic"`
+	ActionTemplate    string   `json:"action_template"`
+	TempCommandTopic  string   `json:"temperature_command_topic,omitempty"`
+	TempCommandTpl    string   `json:"temperature_command_template,omitempty"`
+	TempStateTopic    string   `json:"temperature_state_topic,omitempty"`
+	TempStateTpl      string   `json:"temperature_state_template,omitempty"`
+	CurrentTempTopic  string   `json:"current_temperature_topic,omitempty"`
+	CurrentTempTpl    string   `json:"current_temperature_template,omitempty"`
+	HumCommandTopic   string   `json:"target_humidity_command_topic,omitempty"`
+	HumCommandTpl     string   `json:"target_humidity_command_template,omitempty"`
+	HumStateTopic     string   `json:"target_humidity_state_topic,omitempty"`
+	HumStateTpl       string   `json:"target_humidity_state_template,omitempty"`
+	CurrentHumTopic   string   `json:"current_humidity_topic,omitempty"`
+	CurrentHumTpl     string   `json:"current_humidity_template,omitempty"`
+	MinTemp           int      `json:"min_temp"`
+	MaxTemp           int      `json:"max_temp"`
+	TempStep          float32  `json:"temp_step,omitempty"`
+	Device            Device   `json:"device,omitempty"`
+}
+
+// climateDiscovery returns the climate entity of the thermostat of the
+// relay n, 1 to 4.
+func climateDiscovery(n int, r *RelayConfig) ClimateDiscovery {
+	t := r.Thermostat
+	id := "thermostat" + strconv.Itoa(n)
+	d := ClimateDiscovery{
+		Home:              "homeassistant/climate/" + id,
+		Name:              r.Name + " thermostat",
+		UniqueID:          DeviceID + "_" + id,
+		ObjectID:          DeviceID + "_" + id,
+		Modes:             []string{protocol.ThermostatOff, t.Action},
+		ModeCommandTopic:  protocol.ThermostatTopic(DeviceID, n) + "/mode/set",
+		ModeStateTopic:    protocol.ThermostatTopic(DeviceID, n),
+		ModeStateTemplate: "{{ value_json.mode }}",
+		ActionTopic:       protocol.ThermostatTopic(DeviceID, n),
+		ActionTemplate:    "{{ value_json.action }}",
+		MinTemp:           0,
+		MaxTemp:           40,
+		Device:            device,
+	}
+	state := protocol.ThermostatTopic(DeviceID, n)
+	if t.Sensor == "humidity" {
+		d.HumCommandTopic = state + "/target/set"
+		d.HumCommandTpl = "{{ (value * " + strconv.Itoa(protocol.HumidityScale) + ") | int }}"
+		d.HumStateTopic = state
+		d.HumStateTpl = protocol.ValueTemplate("target", protocol.HumidityScale)
+		d.CurrentHumTopic = state
+		// None while the failsafe leaves current out
+		d.CurrentHumTpl = protocol.ValueTemplate("current", protocol.HumidityScale)
+		return d
+	}
+	d.TempCommandTopic = state + "/target/set"
+	d.TempCommandTpl = "{{ (value * " + strconv.Itoa(protocol.TemperatureScale) + ") | int }}"
+	d.TempStateTopic = state
+	d.TempStateTpl = protocol.ValueTemplate("target", protocol.TemperatureScale)
+	d.CurrentTempTopic = state
+	// None while the failsafe leaves current out
+	d.CurrentTempTpl = protocol.ValueTemplate("current", protocol.TemperatureScale)
+	d.TempStep = 0.5
+	return d
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/sntp"
+	"tinygo.org/x/drivers/net"
+)
+
+const (
+	// ntpLocalPort is the UDP port the SNTP reply is received on.
+	ntpLocalPort = 2390
+	// ntpRetryInterval is the wait after a failed synchronisation.
+	ntpRetryInterval = 15 * time.Minute
+)
+
+var (
+	// lastTimeSync is the (monotonic) time of the last successful sync,
+	// lastSyncUTC the date the RTC was set to. timeSynced tells whether
+	// there was a sync at all.
+	lastTimeSync time.Time
+	lastSyncUTC  time.Time
+	timeSynced   bool
+	nextTimeSync time.Time
+
+	// syncDrift is the error of the RTC corrected at the last sync, in
+	// seconds. driftRate is the same error expressed in parts per million
+	// of the time elapsed since the previous sync.
+	syncDrift int32
+	driftRate int32
+)
+
+// timeSyncDue reports whether the periodic synchronisation should run.
+func timeSyncDue() bool {
+	return !time.Now().Before(nextTimeSync)
+}
+
+// syncTime queries the configured SNTP server and sets the RTC. The wifinina
+// driver only handles one socket at a time, so MQTT must not be connected
+// while this runs.
+func syncTime() error {
+	nextTimeSync = time.Now().Add(ntpRetryInterval)
+	println("[NTP] querying", config.NTPServer)
+	raddr, err := net.ResolveUDPAddr("udp", config.NTPServer+":"+strconv.Itoa(sntp.Port))
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", &net.UDPAddr{Port: ntpLocalPort}, raddr)
+	if err != nil {
+		return err
+	}
+	res, err := sntp.Query(conn, 5*time.Second)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	received := time.Now()
+
+	// The DS3231 has a resolution of one second, wait for the next whole
+	// second so the value written is exact.
+	now := res.Time.Add(time.Since(received))
+	next := now.Truncate(time.Second).Add(time.Second)
+	time.Sleep(next.Sub(now))
+
+	if rtcEnabled && rtcTimeValid {
+		if old, err := rtc.ReadTime(); err == nil {
+			syncDrift = int32(old.Sub(next) / time.Second)
+			if timeSynced {
+				elapsed := int64(time.Since(lastTimeSync) / time.Second)
+				if elapsed > 0 {
+					driftRate = int32(int64(syncDrift) * 1e6 / elapsed)
+				}
+			}
+			println("[NTP] RTC drift:", syncDrift, "s,", driftRate, "ppm")
+		}
+	}
+	// without RTC the time is kept from lastSyncUTC
+	if rtcEnabled {
+		if err := rtc.SetTime(next); err != nil {
+			return err
+		}
+	}
+	println("[NTP] time set to", next.Format(time.RFC3339), "stratum", res.Stratum)
+
+	rtcTimeValid = true
+	timeSynced = true
+	lastTimeSync = time.Now()
+	lastSyncUTC = next
+	nextTimeSync = lastTimeSync.Add(time.Duration(config.NTPInterval) * time.Minute)
+	return nil
+}
+
+// resyncTime runs a periodic synchronisation, taking the MQTT connection
+// down for the duration of the UDP exchange.
+func resyncTime() {
+	cl.Disconnect(100)
+	connectedMQTT = false
+	if err := syncTime(); err != nil {
+		println("[NTP]", err.Error())
+	}
+	connectToMQTT()
+}
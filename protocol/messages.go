@@ -0,0 +1,255 @@
+package protocol
+
+// Device is the descriptor a feeder announces: the short form (ID and Name
+// only) on DiscoveryTopic and the full form on DeviceTopic.
+type Device struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Out     []Value  `json:"out,omitempty"`
+	Methods []Method `json:"methods,omitempty"`
+	// Relays are the names of the relays, from the device configuration.
+	Relays []string `json:"relays,omitempty"`
+}
+
+// Value describes an output of the device or a parameter of a method.
+// Numeric outputs are fixed-point, divide them by Scale to get Unit.
+type Value struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Unit  string      `json:"unit,omitempty"`
+	Scale int         `json:"scale,omitempty"`
+	Time  string      `json:"time,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type Method struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Params      []Value `json:"params,omitempty"`
+}
+
+// Event priorities.
+const (
+	PriorityInfo uint8 = iota
+	PriorityWarning
+	PriorityCritical
+)
+
+// Event is a notification published on EventsTopic, ID is the device that
+// sent it and Time is RFC 3339. The kind of event travels as the "event"
+// parameter, see Event.Kind.
+type Event struct {
+	ID       string  `json:"id"`
+	Message  string  `json:"message,omitempty"`
+	Priority uint8   `json:"priority,omitempty"`
+	Time     string  `json:"time,omitempty"`
+	Extra    []Param `json:"extra,omitempty"`
+}
+
+type Param struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+// Kind returns the kind of the event, e.g. "eeprom_write".
+func (e *Event) Kind() string {
+	return e.Param("event")
+}
+
+// Param returns the value of the named extra parameter.
+func (e *Event) Param(name string) string {
+	for _, p := range e.Extra {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// SensorState is published on SensorStateTopic. Readings are fixed-point
+// integers, see units.go for their scales and units.
+type SensorState struct {
+	Schema uint8 `json:"schema"`
+	// Temperature, Humidity, Pressure and Distance are the last good
+	// readings, left out when there is none or it is stale. Readings tells
+	// their age and the failed reads.
+	Temperature *int32  `json:"temperature,omitempty"`
+	Humidity    *int32  `json:"humidity,omitempty"`
+	Pressure    *int32  `json:"pressure,omitempty"`
+	Distance    *uint16 `json:"distance,omitempty"`
+	Level       *uint8  `json:"level,omitempty"`
+	EEPROM      []byte  `json:"eeprom,omitempty"`
+	Timestamp   string  `json:"timestamp,omitempty"`
+	// RTCDrift is the RTC time minus the network time in seconds, only set
+	// when the network time is known.
+	RTCDrift  *int32 `json:"rtc_drift,omitempty"`
+	TimeValid bool   `json:"time_valid"`
+	// LastSync is the time the RTC was last set over SNTP, SyncDrift the
+	// error it corrected in seconds and DriftRate that error in ppm.
+	LastSync  string `json:"last_sync,omitempty"`
+	SyncDrift int32  `json:"sync_drift"`
+	DriftRate int32  `json:"drift_rate"`
+	// DewPoint, AbsoluteHumidity and HeatStress are derived from the
+	// temperature and the humidity, Welfare is the class of HeatStress:
+	// WelfareOK, WelfareWarm or WelfareDangerous. They are missing when the
+	// BME280 could not be read, a zero is a real value.
+	DewPoint         *int32 `json:"dew_point,omitempty"`
+	AbsoluteHumidity *int32 `json:"absolute_humidity,omitempty"`
+	HeatStress       *int32 `json:"heat_stress,omitempty"`
+	Welfare          string `json:"welfare,omitempty"`
+	// Devices tells which I2C devices answered the last probe, the
+	// readings of a missing device are left out.
+	Devices  Devices  `json:"devices"`
+	Readings Readings `json:"readings"`
+}
+
+// ReadingState is the health of a reading of SensorState: Age is the
+// number of seconds since its last good value was read, nil until there is
+// one. Errors counts the failed and implausible reads since boot.
+type ReadingState struct {
+	Age    *uint32 `json:"age,omitempty"`
+	Errors uint32  `json:"errors"`
+}
+
+// Readings holds the ReadingState of each reading.
+type Readings struct {
+	Temperature ReadingState `json:"temperature"`
+	Humidity    ReadingState `json:"humidity"`
+	Pressure    ReadingState `json:"pressure"`
+	Distance    ReadingState `json:"distance"`
+}
+
+// Devices holds whether each I2C device of the feeder is present.
+type Devices struct {
+	BME280  bool `json:"bme280"`
+	RTC     bool `json:"rtc"`
+	EEPROM  bool `json:"eeprom"`
+	VL6180X bool `json:"vl6180x"`
+}
+
+// RelayState is published on RelayStateTopic, every relay is "ON" or "OFF".
+// TimerN is the number of seconds before the relay N reverts, when it runs
+// a timed command. OverrideN is set while a manual command overrides the
+// schedule of the relay N, until its next event.
+type RelayState struct {
+	Relay1 string `json:"relay1,omitempty"`
+	Relay2 string `json:"relay2,omitempty"`
+	Relay3 string `json:"relay3,omitempty"`
+	Relay4 string `json:"relay4,omitempty"`
+	Timer1 uint32 `json:"timer1,omitempty"`
+	Timer2 uint32 `json:"timer2,omitempty"`
+	Timer3 uint32 `json:"timer3,omitempty"`
+	Timer4 uint32 `json:"timer4,omitempty"`
+
+	Override1 bool `json:"override1,omitempty"`
+	Override2 bool `json:"override2,omitempty"`
+	Override3 bool `json:"override3,omitempty"`
+	Override4 bool `json:"override4,omitempty"`
+}
+
+// I2CStats counts the failed transfers with an I2C device since boot,
+// Timeouts are the failures where the bus did not answer at all.
+type I2CStats struct {
+	Errors   uint32 `json:"errors"`
+	Timeouts uint32 `json:"timeouts"`
+}
+
+// I2CState is published on I2CTopic and returned by the "i2c" method.
+// Recoveries counts the times the bus was found stuck and reset, Scan
+// holds the addresses that answered the last bus scan.
+type I2CState struct {
+	BME280     I2CStats `json:"bme280"`
+	RTC        I2CStats `json:"rtc"`
+	EEPROM     I2CStats `json:"eeprom"`
+	VL6180X    I2CStats `json:"vl6180x"`
+	Recoveries uint32   `json:"recoveries"`
+	Scan       []int    `json:"scan,omitempty"`
+}
+
+// Status is the result of the "status" method: the last sensor readings,
+// the current relays and whether the motor is running.
+type Status struct {
+	Sensors SensorState `json:"sensors"`
+	Relays  RelayState  `json:"relays"`
+	Motor   string      `json:"motor"`
+}
+
+// RTCTime is the result of the "grtc" method, Local is in the time zone of
+// the device.
+type RTCTime struct {
+	Timestamp string `json:"timestamp"`
+	TimeValid bool   `json:"time_valid"`
+	Local     string `json:"local"`
+}
+
+// Alarm is a daily feeding at a local time of day, published on
+// ScheduleTopic. Last and Next are unix seconds.
+type Alarm struct {
+	Hour     uint8  `json:"hour"`
+	Minute   uint8  `json:"minute"`
+	Enabled  bool   `json:"enabled"`
+	Quantity uint32 `json:"quantity"`
+	Last     int64  `json:"last,omitempty"`
+	Next     int64  `json:"next,omitempty"`
+}
+
+// Thermostat modes and actions, as Home Assistant names the HVAC modes
+// and actions of its climate entities.
+const (
+	ThermostatOff     = "off"
+	ThermostatHeat    = "heat"
+	ThermostatCool    = "cool"
+	ThermostatIdle    = "idle"
+	ThermostatHeating = "heating"
+	ThermostatCooling = "cooling"
+)
+
+// ThermostatState is published on ThermostatTopic for every relay driven
+// by a thermostat. Target and Current use the scale of the sensor, Current
+// is missing when the sensor failed and the relay is in its Failsafe
+// state. Duty is the share of the period the relay is on, in percent, for
+// the time-proportional mode.
+type ThermostatState struct {
+	Mode     string `json:"mode"`
+	Action   string `json:"action"`
+	Sensor   string `json:"sensor"`
+	Target   int32  `json:"target"`
+	Current  *int32 `json:"current,omitempty"`
+	Failsafe bool   `json:"failsafe,omitempty"`
+	Duty     *uint8 `json:"duty,omitempty"`
+}
+
+// RelayEvent switches a relay to State, "ON" or "OFF", at a local time of
+// day.
+type RelayEvent struct {
+	Hour   uint8  `json:"hour"`
+	Minute uint8  `json:"minute"`
+	State  string `json:"state"`
+}
+
+// RelaySchedule holds the daily events of relays 1 to 4, published on
+// RelayScheduleTopic. When setting it, a shorter array or a null element
+// leaves the following relays unchanged, an empty one clears the relay.
+type RelaySchedule [4][]RelayEvent
+
+// EEPROMRequest is the payload of the "gm" and "sm" methods, and of the
+// commands sent to EEPROMTopic. Writes take either a single byte V or a
+// block Data starting at P. Writes to reserved regions need Force.
+type EEPROMRequest struct {
+	Token string `json:"token,omitempty"`
+	P     int    `json:"p"`
+	N     int    `json:"n,omitempty"`
+	V     *uint8 `json:"v,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+	Force bool   `json:"force,omitempty"`
+}
+
+// EEPROMReply is the result of the EEPROM commands.
+type EEPROMReply struct {
+	P     int    `json:"p"`
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
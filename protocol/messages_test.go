@@ -0,0 +1,34 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEventKind(t *testing.T) {
+	data := []byte(`{"id":"rabbitf3","message":"Food dispensed","time":"2024-06-01T08:00:00Z",
+		"extra":[{"name":"event","type":"string","value":"feeding"},
+		{"name":"quantity","type":"int","value":"50"},
+		{"name":"source","type":"string","value":"call"}]}`)
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Kind() != "feeding" {
+		t.Errorf("kind %q, want feeding", e.Kind())
+	}
+	if e.Param("quantity") != "50" || e.Param("source") != "call" {
+		t.Errorf("params %+v", e.Extra)
+	}
+	if e.Param("missing") != "" {
+		t.Error("missing param has a value")
+	}
+	if e.Priority != PriorityInfo {
+		t.Errorf("priority %d, want info", e.Priority)
+	}
+
+	var none Event
+	if none.Kind() != "" {
+		t.Errorf("event without extra has kind %q", none.Kind())
+	}
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Relay command actions.
+const (
+	RelayOn     = "ON"
+	RelayOff    = "OFF"
+	RelayToggle = "TOGGLE"
+	RelayPulse  = "PULSE"
+)
+
+// Bounds of the relay timers.
+const (
+	MinRelayTimer = 50 * time.Millisecond
+	MaxRelayTimer = 24 * time.Hour
+)
+
+var ErrInvalidRelayCommand = errors.New("invalid relay command")
+
+// RelayCommand is a command for one relay, sent on its Home Assistant
+// command topic or as the "s" param of the "relay" method:
+//
+//	ON | OFF | TOGGLE
+//	ON for 10m | OFF for 1h30m   the relay reverts when the time is up
+//	PULSE 500ms                  same as ON for 500ms
+//
+// Commands are case insensitive, durations use the time.ParseDuration
+// syntax.
+type RelayCommand struct {
+	Action string
+	For    time.Duration
+}
+
+func ParseRelayCommand(s string) (RelayCommand, error) {
+	fields := strings.Fields(strings.ToUpper(s))
+	var c RelayCommand
+	switch {
+	case len(fields) == 1 && (fields[0] == RelayOn || fields[0] == RelayOff || fields[0] == RelayToggle):
+		c.Action = fields[0]
+		return c, nil
+	case len(fields) == 3 && (fields[0] == RelayOn || fields[0] == RelayOff) && fields[1] == "FOR":
+		c.Action = fields[0]
+		return c, c.parseDuration(fields[2])
+	case len(fields) == 2 && fields[0] == RelayPulse:
+		c.Action = RelayOn
+		return c, c.parseDuration(fields[1])
+	}
+	return c, ErrInvalidRelayCommand
+}
+
+func (c *RelayCommand) parseDuration(s string) error {
+	d, err := time.ParseDuration(strings.ToLower(s))
+	if err != nil || d < MinRelayTimer || d > MaxRelayTimer {
+		return ErrInvalidRelayCommand
+	}
+	c.For = d
+	return nil
+}
+
+func (c RelayCommand) String() string {
+	if c.For == 0 {
+		return c.Action
+	}
+	return c.Action + " for " + c.For.String()
+}
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRelayCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want RelayCommand
+		str  string
+	}{
+		{"ON", RelayCommand{Action: RelayOn}, "ON"},
+		{"off", RelayCommand{Action: RelayOff}, "OFF"},
+		{" Toggle ", RelayCommand{Action: RelayToggle}, "TOGGLE"},
+		{"on for 10m", RelayCommand{Action: RelayOn, For: 10 * time.Minute}, "ON for 10m0s"},
+		{"OFF FOR 1H30M", RelayCommand{Action: RelayOff, For: 90 * time.Minute}, "OFF for 1h30m0s"},
+		{"pulse 500ms", RelayCommand{Action: RelayOn, For: 500 * time.Millisecond}, "ON for 500ms"},
+		{"PULSE 500MS", RelayCommand{Action: RelayOn, For: 500 * time.Millisecond}, "ON for 500ms"},
+		// the bounds are included
+		{"pulse 50ms", RelayCommand{Action: RelayOn, For: MinRelayTimer}, "ON for 50ms"},
+		{"on for 24h", RelayCommand{Action: RelayOn, For: MaxRelayTimer}, "ON for 24h0m0s"},
+	}
+	for _, tt := range tests {
+		got, err := ParseRelayCommand(tt.in)
+		if err != nil {
+			t.Errorf("ParseRelayCommand(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRelayCommand(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+		if got.String() != tt.str {
+			t.Errorf("%q: String() = %q, want %q", tt.in, got.String(), tt.str)
+		}
+		// String gives back a command that parses to the same one
+		if again, err := ParseRelayCommand(got.String()); err != nil || again != got {
+			t.Errorf("%q: reparsed %+v, %v", got.String(), again, err)
+		}
+	}
+}
+
+func TestParseRelayCommandInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"maybe",
+		"on off",
+		"toggle for 1m",
+		"pulse",
+		"pulse 1m 2m",
+		"off 10m",
+		"on for",
+		"on for ten minutes",
+		"on for 10",
+		"on for -1m",
+		"pulse 49ms",
+		"on for 24h1s",
+	} {
+		if c, err := ParseRelayCommand(s); err != ErrInvalidRelayCommand {
+			t.Errorf("ParseRelayCommand(%q) = %+v, %v", s, c, err)
+		}
+	}
+}
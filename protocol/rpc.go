@@ -0,0 +1,69 @@
+package protocol
+
+import "encoding/json"
+
+// Request is published on CallTopic. Params is a JSON object keyed by the
+// Value.ID of each parameter, as listed in the descriptor. The response is
+// published on Reply, or on ReplyTopic when Reply is not a topic under
+// ReplyPrefix, and carries the same ID so callers can match it with their
+// request.
+type Request struct {
+	ID     string          `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Reply  string          `json:"reply,omitempty"`
+	Token  string          `json:"token,omitempty"`
+}
+
+// SetRequest is the payload of the "/set" topics of ConfigTopic,
+// ScheduleTopic and RelayScheduleTopic, which write the EEPROM of the
+// device. Value is what the method of the same name takes as params.
+type SetRequest struct {
+	Token string          `json:"token"`
+	Value json.RawMessage `json:"value"`
+}
+
+type Response struct {
+	ID     string      `json:"id,omitempty"`
+	Device string      `json:"device"`
+	Method string      `json:"method"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// NewRequest builds a request, params may be nil or any value that encodes
+// to a JSON object.
+func NewRequest(id, method string, params interface{}) (Request, error) {
+	req := Request{ID: id, Method: method}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return Request{}, err
+		}
+		req.Params = raw
+	}
+	return req, nil
+}
+
+// DecodeResponse decodes a response, storing its result in result when it
+// is a non nil pointer.
+func DecodeResponse(data []byte, result interface{}) (Response, error) {
+	res := Response{Result: result}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return Response{}, err
+	}
+	return res, nil
+}
+
+// DecodeSensorState decodes a SensorState, refusing payloads written with a
+// newer schema than this package knows about.
+func DecodeSensorState(data []byte) (SensorState, error) {
+	var s SensorState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return SensorState{}, err
+	}
+	if s.Schema > SchemaVersion {
+		return SensorState{}, ErrUnknownSchema
+	}
+	return s, nil
+}
@@ -0,0 +1,177 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	req, err := NewRequest("42", "food", map[string]uint32{"q": 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Reply = ReplyPrefix + "feederctl/test"
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Request
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	var p struct {
+		Q uint32 `json:"q"`
+	}
+	if err := json.Unmarshal(got.Params, &p); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != "42" || got.Method != "food" || got.Reply != req.Reply || p.Q != 50 {
+		t.Errorf("got %+v, params %+v", got, p)
+	}
+
+	res := Response{ID: got.ID, Device: "rabbitf3", Method: got.Method, Result: p.Q}
+	data, err = json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fed uint32
+	decoded, err := DecodeResponse(data, &fed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != "42" || decoded.Device != "rabbitf3" || decoded.Error != "" || fed != 50 {
+		t.Errorf("got %+v, result %d", decoded, fed)
+	}
+}
+
+func TestNewRequestWithoutParams(t *testing.T) {
+	req, err := NewRequest("1", "info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(req)
+	if strings.Contains(string(data), "params") {
+		t.Errorf("params sent: %s", data)
+	}
+	if _, err := NewRequest("1", "info", func() {}); err == nil {
+		t.Error("unencodable params accepted")
+	}
+}
+
+func TestDecodeResponseError(t *testing.T) {
+	var result uint32
+	res, err := DecodeResponse([]byte(`{"id":"7","device":"rabbitf3","method":"food","error":"invalid params"}`), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != "invalid params" || result != 0 {
+		t.Errorf("got %+v, result %d", res, result)
+	}
+	if _, err := DecodeResponse([]byte(`{"id":`), nil); err == nil {
+		t.Error("truncated response decoded")
+	}
+}
+
+func TestDecodeSensorState(t *testing.T) {
+	temp := int32(21500)
+	level := uint8(80)
+	age := uint32(0)
+	dew := int32(0)
+	in := SensorState{
+		Schema:      SchemaVersion,
+		Temperature: &temp,
+		Level:       &level,
+		DewPoint:    &dew,
+		TimeValid:   true,
+		Devices:     Devices{BME280: true, RTC: true},
+		Readings:    Readings{Temperature: ReadingState{Age: &age}, Humidity: ReadingState{Errors: 3}},
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a fresh reading has an age, one never read has none
+	if !strings.Contains(string(data), `"temperature":{"age":0,`) || strings.Count(string(data), `"age"`) != 1 {
+		t.Errorf("reading ages: %s", data)
+	}
+	// a dew point of 0°C is a value, the heat stress is missing
+	if !strings.Contains(string(data), `"dew_point":0`) || strings.Contains(string(data), `"heat_stress"`) {
+		t.Errorf("derived values: %s", data)
+	}
+	for _, field := range []string{`"humidity":`, `"pressure":`, `"distance":`} {
+		// the field is only present inside readings
+		if strings.Count(string(data), field) != 1 {
+			t.Errorf("nil reading %s not omitted: %s", field, data)
+		}
+	}
+
+	s, err := DecodeSensorState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Temperature == nil || *s.Temperature != temp || s.Level == nil || *s.Level != level {
+		t.Errorf("readings lost: %+v", s)
+	}
+	if s.DewPoint == nil || *s.DewPoint != 0 || s.HeatStress != nil || s.AbsoluteHumidity != nil {
+		t.Errorf("derived values: %v, %v, %v", s.DewPoint, s.HeatStress, s.AbsoluteHumidity)
+	}
+	if s.Humidity != nil || s.Pressure != nil || s.Distance != nil {
+		t.Errorf("omitted readings decoded: %+v", s)
+	}
+	if !s.TimeValid || s.Devices != in.Devices || s.Readings.Humidity != in.Readings.Humidity {
+		t.Errorf("got %+v, want %+v", s, in)
+	}
+	if a := s.Readings.Temperature.Age; a == nil || *a != 0 || s.Readings.Pressure.Age != nil {
+		t.Errorf("ages %v, %v", a, s.Readings.Pressure.Age)
+	}
+}
+
+func TestDecodeSensorStateSchema(t *testing.T) {
+	if _, err := DecodeSensorState([]byte(`{"schema":1,"temperature":21}`)); err != nil {
+		t.Errorf("older schema: %v", err)
+	}
+	newer, _ := json.Marshal(SensorState{Schema: SchemaVersion + 1})
+	if _, err := DecodeSensorState(newer); err != ErrUnknownSchema {
+		t.Errorf("newer schema: got %v, want %v", err, ErrUnknownSchema)
+	}
+	if _, err := DecodeSensorState([]byte(`[]`)); err == nil {
+		t.Error("invalid payload decoded")
+	}
+}
+
+func TestValidReplyTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{ReplyPrefix + "dashboard/client", true},
+		{ReplyPrefix + "feederctl/abc", true},
+		{"", false},
+		{ReplyPrefix, false},
+		{ReplyTopic("rabbitf3"), false},
+		{CallTopic("rabbitf3"), false},
+		{ReplyPrefix + "#", false},
+		{ReplyPrefix + "+/x", false},
+	}
+	for _, tt := range tests {
+		if got := ValidReplyTopic(tt.topic); got != tt.want {
+			t.Errorf("ValidReplyTopic(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestSetRequest(t *testing.T) {
+	var req SetRequest
+	if err := json.Unmarshal([]byte(`{"token":"secret","value":[null,[{"hour":7,"minute":0,"state":"ON"}]]}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	var s RelaySchedule
+	if err := json.Unmarshal(req.Value, &s); err != nil {
+		t.Fatal(err)
+	}
+	if req.Token != "secret" || len(s[0]) != 0 || len(s[1]) != 1 || s[1][0].State != RelayOn {
+		t.Errorf("got %q %+v", req.Token, s)
+	}
+}
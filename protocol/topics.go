@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// DiscoveryTopic receives the short descriptor of every device.
+	DiscoveryTopic = "discovery"
+	// DiscoveryRequestTopic asks every device to announce itself again.
+	DiscoveryRequestTopic = "discovery/request"
+	// EventsTopic receives the events of every device.
+	EventsTopic = "events"
+)
+
+// DeviceTopic receives the full descriptor of the device.
+func DeviceTopic(id string) string { return id + "/device" }
+
+// SensorStateTopic receives the SensorState of the device, the Home
+// Assistant discovery messages point at it.
+func SensorStateTopic(id string) string { return id + "/sensors" }
+
+// RelayStateTopic receives the RelayState of the device.
+func RelayStateTopic(id string) string { return id + "/relays" }
+
+// MotorStateTopic receives "ON" while the device is dispensing food.
+func MotorStateTopic(id string) string { return id + "/motor" }
+
+// CallTopic receives the method calls for the device.
+func CallTopic(id string) string { return id + "/call" }
+
+// ReplyTopic receives the responses of the device when the request did not
+// name a reply topic.
+func ReplyTopic(id string) string { return id + "/reply" }
+
+// ReplyPrefix starts the reply topics a request may name, the device
+// answers on ReplyTopic when the topic is anything else.
+const ReplyPrefix = "reply/"
+
+// ValidReplyTopic tells whether the device may publish a response on topic:
+// a topic under ReplyPrefix, without wildcards.
+func ValidReplyTopic(topic string) bool {
+	return len(topic) > len(ReplyPrefix) && strings.HasPrefix(topic, ReplyPrefix) &&
+		!strings.ContainsAny(topic, "+#")
+}
+
+// ConfigTopic receives the configuration, publish to ConfigTopic + "/set"
+// to change it.
+func ConfigTopic(id string) string { return id + "/config" }
+
+// ScheduleTopic receives the feeding schedule, publish to
+// ScheduleTopic + "/set" to change it.
+func ScheduleTopic(id string) string { return id + "/schedule" }
+
+// RelayScheduleTopic receives the RelaySchedule of the device, publish to
+// RelayScheduleTopic + "/set" to change it.
+func RelayScheduleTopic(id string) string { return id + "/relay_schedule" }
+
+// ThermostatTopic receives the ThermostatState of the relay n, 1 to 4.
+// Publish an HVAC mode to ThermostatTopic + "/mode/set", or a target in
+// the scale of the sensor to ThermostatTopic + "/target/set".
+func ThermostatTopic(id string, n int) string { return id + "/thermostat" + strconv.Itoa(n) }
+
+// I2CTopic receives the I2CState of the device.
+func I2CTopic(id string) string { return id + "/i2c" }
+
+// EEPROMTopic receives the replies to the EEPROM commands, sent to
+// EEPROMTopic + "/get" and EEPROMTopic + "/set".
+func EEPROMTopic(id string) string { return id + "/eeprom" }
+
+// DeviceSubscription matches every topic of the device.
+func DeviceSubscription(id string) string { return id + "/#" }
@@ -0,0 +1,77 @@
+// Package protocol holds the wire format shared by the feeder firmware and
+// the dashboard. It only depends on packages TinyGo can compile.
+package protocol
+
+import (
+	"errors"
+	"strconv"
+)
+
+// SchemaVersion identifies the layout and units of SensorState. Bump it every
+// time a field is added or changes meaning so consumers can tell formats
+// apart.
+//
+//	1: unversioned payloads, scales were not documented
+//	2: fixed-point SI units as described below
+//	3: "date" renamed to "timestamp", adds "rtc_drift" and "time_valid"
+//	4: adds "last_sync", "sync_drift" and "drift_rate"
+//	5: adds "level"
+//	6: adds "dew_point", "absolute_humidity", "heat_stress" and "welfare"
+//	7: adds "devices", "level" is left out with the distance
+//	8: a zero reading is valid, the failed ones are left out; adds
+//	   "readings"
+//	9: a zero "dew_point", "absolute_humidity" or "heat_stress" is valid,
+//	   they are left out when the BME280 could not be read
+const SchemaVersion = 9
+
+// ErrUnknownSchema is returned for payloads newer than SchemaVersion.
+var ErrUnknownSchema = errors.New("protocol: unknown schema version")
+
+// Sensor readings travel as integers: the value in SI units multiplied by its
+// scale. The scales match what the BME280 driver returns, so the firmware
+// never needs floating point to fill a SensorState.
+const (
+	// TemperatureScale: milli degrees Celsius (°C/1000).
+	TemperatureScale = 1000
+	// HumidityScale: hundredths of a percent of relative humidity.
+	HumidityScale = 100
+	// PressureScale: milli pascals (Pa/1000).
+	PressureScale = 1000
+	// DistanceScale: millimetres, already an integer.
+	DistanceScale = 1
+)
+
+// Units of the values once the scale has been applied.
+const (
+	TemperatureUnit = "°C"
+	HumidityUnit    = "%"
+	PressureUnit    = "Pa"
+	DistanceUnit    = "mm"
+)
+
+// Celsius converts a wire temperature to degrees Celsius.
+func Celsius(v int32) float32 {
+	return float32(v) / TemperatureScale
+}
+
+// RelativeHumidity converts a wire humidity to percent.
+func RelativeHumidity(v int32) float32 {
+	return float32(v) / HumidityScale
+}
+
+// Pascal converts a wire pressure to pascals.
+func Pascal(v int32) float32 {
+	return float32(v) / PressureScale
+}
+
+// ValueTemplate returns the Home Assistant template that extracts field from
+// a JSON payload and applies scale, so HA and the dashboard share one
+// definition of every unit.
+func ValueTemplate(field string, scale int) string {
+	v := "value_json." + field
+	if scale > 1 {
+		v += " / " + strconv.Itoa(scale)
+	}
+	// a missing value is unknown, rather than an error or a zero
+	return "{{ " + v + " if value_json." + field + " is defined else None }}"
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import "testing"
+
+// TestValueTemplate checks that a value left out of the payload is None
+// for Home Assistant, e.g. the current reading of a thermostat in
+// failsafe, rather than an error.
+func TestValueTemplate(t *testing.T) {
+	tests := []struct {
+		field string
+		scale int
+		want  string
+	}{
+		{"current", TemperatureScale, "{{ value_json.current / 1000 if value_json.current is defined else None }}"},
+		{"level", 1, "{{ value_json.level if value_json.level is defined else None }}"},
+	}
+	for _, tt := range tests {
+		if got := ValueTemplate(tt.field, tt.scale); got != tt.want {
+			t.Errorf("ValueTemplate(%q, %d) = %s, want %s", tt.field, tt.scale, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import "math"
+
+// Welfare classes of the heat-stress index.
+const (
+	WelfareOK        = "ok"
+	WelfareWarm      = "warm"
+	WelfareDangerous = "dangerous"
+)
+
+// Scales and units of the values derived from the temperature and the
+// humidity. The dew point uses TemperatureScale.
+const (
+	// AbsoluteHumidityScale: milligrams per cubic metre.
+	AbsoluteHumidityScale = 1000
+	AbsoluteHumidityUnit  = "g/m³"
+	// HeatStressScale: thousandths of the index.
+	HeatStressScale = 1000
+)
+
+// DewPoint returns the dew point of a wire temperature and humidity, in the
+// wire temperature scale, with the Magnus formula. The humidity must be
+// above zero.
+func DewPoint(t, h int32) int32 {
+	tc := float64(t) / TemperatureScale
+	g := math.Log(float64(h)/HumidityScale/100) + 17.62*tc/(243.12+tc)
+	return int32(243.12 * g / (17.62 - g) * TemperatureScale)
+}
+
+// AbsoluteHumidity returns the mass of water vapour in the air, in
+// AbsoluteHumidityScale, from a wire temperature and humidity.
+func AbsoluteHumidity(t, h int32) int32 {
+	tc := float64(t) / TemperatureScale
+	rh := float64(h) / HumidityScale
+	saturation := 6.112 * math.Exp(17.67*tc/(tc+243.5))
+	return int32(saturation * rh * 2.1674 / (273.15 + tc) * AbsoluteHumidityScale)
+}
+
+// HeatStressIndex returns the temperature-humidity index used for rabbits
+// (Marai et al., 2001), in HeatStressScale:
+//
+//	THI = t - (0.31 - 0.31 RH) (t - 14.4)
+//
+// with t in °C and RH as a fraction. Below 27.8 there is no heat stress,
+// it is severe above 28.9 and very severe above 30.
+func HeatStressIndex(t, h int32) int32 {
+	// integer arithmetic, t in milli degrees and h in hundredths of a percent
+	d := int64(t) - 14400
+	return int32(int64(t) - 31*int64(100*HumidityScale-h)*d/(100*100*HumidityScale))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// readingStale is how long the last good value of a reading is still
+// published after failed reads.
+const readingStale = 5 * time.Minute
+
+// reading keeps the last good value of a sensor reading. The values out
+// of [lo, hi], the range of the sensor, are failures as well.
+type reading struct {
+	lo, hi int32
+	value  int32
+	at     time.Time
+	// failed is the first failed read since the last good one, zero when
+	// the last read was good
+	failed time.Time
+	// seconds is the age of value, state points at it once there is one
+	seconds uint32
+	state   *protocol.ReadingState
+}
+
+var errDistance = errors.New("distance not measured")
+
+var (
+	temperatureReading = reading{lo: -40 * protocol.TemperatureScale, hi: 85 * protocol.TemperatureScale,
+		state: &sensorState.Readings.Temperature}
+	humidityReading = reading{lo: 0, hi: 100 * protocol.HumidityScale,
+		state: &sensorState.Readings.Humidity}
+	pressureReading = reading{lo: 30000 * protocol.PressureScale, hi: 110000 * protocol.PressureScale,
+		state: &sensorState.Readings.Pressure}
+	// the VL6180X measures up to 255mm
+	distanceReading = reading{lo: 0, hi: 255,
+		state: &sensorState.Readings.Distance}
+)
+
+// update records a read made at now, it returns whether v is good.
+func (r *reading) update(v int32, err error, now time.Time) bool {
+	if err != nil || v < r.lo || v > r.hi {
+		r.state.Errors++
+		if err == nil {
+			println("[SENSORS] implausible reading", v)
+		}
+		r.age(now)
+		return false
+	}
+	r.value, r.at, r.failed = v, now, time.Time{}
+	r.seconds = 0
+	r.state.Age = &r.seconds
+	return true
+}
+
+// age updates the age of the last good value, without reading: the read
+// failed or the sensor is missing.
+func (r *reading) age(now time.Time) {
+	if r.failed.IsZero() {
+		r.failed = now
+	}
+	if !r.at.IsZero() {
+		r.seconds = uint32(now.Sub(r.at) / time.Second)
+	}
+}
+
+// last returns the value to publish, nil when there is none or it is
+// stale.
+func (r *reading) last(now time.Time) *int32 {
+	if r.at.IsZero() || now.Sub(r.at) > readingStale {
+		return nil
+	}
+	v := r.value
+	return &v
+}
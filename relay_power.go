@@ -0,0 +1,132 @@
+package main
+
+import (
+	"machine"
+	"time"
+)
+
+const (
+	// RelayStateAddress is the EEPROM ring of the last relay states, one
+	// byte per slot: a sequence number 0-14 in the high nibble and one bit
+	// per relay in the low nibble. Erased slots read as 0xFF. Every save
+	// goes to the slot after the last one, spreading the wear.
+	RelayStateAddress = 0x070
+	RelayStateSlots   = 32
+
+	// relaySaveDelay is how long the relays must hold their state before it
+	// is stored, pulses and short timers never reach the EEPROM.
+	relaySaveDelay = 10 * time.Second
+)
+
+// Power-on behaviours of the relays.
+const (
+	PowerOnOff     = "off"
+	PowerOnOn      = "on"
+	PowerOnRestore = "restore"
+)
+
+var (
+	relayStateSlot = -1 // slot of the stored state, -1 when none
+	relayStored    byte // content of the slot
+	relaySaveAt    time.Time
+)
+
+// loadRelayStates finds the last state stored in the ring.
+func loadRelayStates() {
+	if !eepromEnabled {
+		return
+	}
+	buf := make([]byte, RelayStateSlots)
+	if _, err := eeprom.ReadAt(buf, RelayStateAddress); err != nil {
+		println("[RELAY] error reading EEPROM", err)
+		return
+	}
+	for i, b := range buf {
+		seq := b >> 4
+		if seq > 14 {
+			continue
+		}
+		next := buf[(i+1)%RelayStateSlots] >> 4
+		if next > 14 || next != (seq+1)%15 {
+			relayStateSlot, relayStored = i, b
+			return
+		}
+	}
+}
+
+// powerOnRelays configures the relay pins and sets every relay as its
+// power_on setting says, before the network is up. The interlocks keep the
+// later relays off on a conflict.
+func powerOnRelays() {
+	for i := range relay {
+		// set the level before driving the pin, an inverted relay must not
+		// click on
+		relay[i].Set(config.Relays[i].Inverted)
+		relay[i].Configure(machine.PinConfig{Mode: machine.PinOutput})
+
+		on := false
+		switch config.Relays[i].PowerOn {
+		case PowerOnOn:
+			on = true
+		case PowerOnRestore:
+			on = relayStateSlot >= 0 && relayStored&(1<<i) != 0
+		}
+		// the network is not up yet for an event
+		if err := setRelay(i, on); err != nil {
+			println("[RELAY]", i+1, "power on", err.Error())
+		}
+	}
+}
+
+// relayStatesToStore returns the bits of the relays restored at power-on.
+// A relay running a timed command is stored in the state it reverts to.
+func relayStatesToStore() byte {
+	var bits byte
+	for i := range relay {
+		if config.Relays[i].PowerOn != PowerOnRestore {
+			continue
+		}
+		on := relayOn(i)
+		if !relayUntil[i].IsZero() && !relayLimit[i] {
+			on = relayRevert[i]
+		}
+		if on {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+// saveRelayStates stores the relay states once they held for
+// relaySaveDelay, only when they differ from the stored ones.
+func saveRelayStates(now time.Time) {
+	if !eepromEnabled {
+		return
+	}
+	bits := relayStatesToStore()
+	// nothing stored restores the relays off
+	if relayStateSlot < 0 && bits == 0 || relayStateSlot >= 0 && bits == relayStored&0x0F {
+		relaySaveAt = time.Time{}
+		return
+	}
+	if relaySaveAt.IsZero() {
+		relaySaveAt = now.Add(relaySaveDelay)
+		return
+	}
+	if now.Before(relaySaveAt) {
+		return
+	}
+	relaySaveAt = time.Time{}
+
+	slot, seq := 0, byte(0)
+	if relayStateSlot >= 0 {
+		slot = (relayStateSlot + 1) % RelayStateSlots
+		seq = (relayStored>>4 + 1) % 15
+	}
+	b := seq<<4 | bits
+	if _, err := eeprom.WriteAt([]byte{b}, int64(RelayStateAddress+slot)); err != nil {
+		println("[RELAY] error writing EEPROM", err)
+		return
+	}
+	relayStateSlot, relayStored = slot, b
+}
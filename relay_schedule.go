@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+const (
+	// RelayScheduleAddress is the EEPROM region of the relay schedules,
+	// RelayEvents events of RelayEventSize bytes for each relay.
+	RelayScheduleAddress = 0x040
+	RelayEvents          = 4
+	RelayEventSize       = 3
+	RelayScheduleSize    = 4 * RelayEvents * RelayEventSize
+)
+
+// Each relay event takes RelayEventSize bytes in the EEPROM: hour, minute
+// and flags, bit 0 set for a used slot and bit 1 for ON.
+//
+// The schedule only acts when an event is due: a manual command overrides
+// it until the next event of the relay. relayLastEvent is the unix time of
+// the last event applied, 0 after boot or a schedule change to apply the
+// state of the schedule on the next check.
+var (
+	relaySchedule  protocol.RelaySchedule
+	relayLastEvent [4]int64
+	relayOverride  [4]bool
+
+	relayScheduleTopic = protocol.RelayScheduleTopic(DeviceID)
+
+	errInvalidRelayEvent = errors.New("invalid relay event")
+)
+
+func decodeRelayEvents(b []byte) []protocol.RelayEvent {
+	events := []protocol.RelayEvent{}
+	for j := 0; j < RelayEvents; j++ {
+		e := b[j*RelayEventSize:]
+		// erased EEPROM reads as 0xFF
+		if e[2]&1 == 0 || e[0] > 23 || e[1] > 59 {
+			continue
+		}
+		state := protocol.RelayOff
+		if e[2]&2 != 0 {
+			state = protocol.RelayOn
+		}
+		events = append(events, protocol.RelayEvent{Hour: e[0], Minute: e[1], State: state})
+	}
+	return events
+}
+
+func encodeRelayEvents(events []protocol.RelayEvent, b []byte) {
+	for j := 0; j < RelayEvents; j++ {
+		e := b[j*RelayEventSize:]
+		e[0], e[1], e[2] = 0, 0, 0
+		if j >= len(events) {
+			continue
+		}
+		e[0], e[1], e[2] = events[j].Hour, events[j].Minute, 1
+		if events[j].State == protocol.RelayOn {
+			e[2] |= 2
+		}
+	}
+}
+
+// loadRelaySchedule reads the relay schedules from the EEPROM.
+func loadRelaySchedule() {
+	for i := range relaySchedule {
+		relaySchedule[i] = []protocol.RelayEvent{}
+	}
+	if !eepromEnabled {
+		return
+	}
+	buf := make([]byte, RelayScheduleSize)
+	if _, err := eeprom.ReadAt(buf, RelayScheduleAddress); err != nil {
+		println("[RELAY] error reading EEPROM", err)
+		return
+	}
+	for i := range relaySchedule {
+		relaySchedule[i] = decodeRelayEvents(buf[i*RelayEvents*RelayEventSize:])
+	}
+}
+
+func saveRelaySchedule(i int) {
+	if !eepromEnabled {
+		return
+	}
+	buf := make([]byte, RelayEvents*RelayEventSize)
+	encodeRelayEvents(relaySchedule[i], buf)
+	if _, err := eeprom.WriteAt(buf, int64(RelayScheduleAddress+i*len(buf))); err != nil {
+		println("[RELAY] error writing EEPROM", err)
+	}
+}
+
+// lastRelayEvent returns the latest event at or before t, and when it
+// happened. See nextFeeding for the DST transitions.
+func lastRelayEvent(events []protocol.RelayEvent, t time.Time) (time.Time, protocol.RelayEvent) {
+	var last time.Time
+	var event protocol.RelayEvent
+	local := localZone.In(t)
+	for _, e := range events {
+		at := localZone.Date(local.Year(), local.Month(), local.Day(), int(e.Hour), int(e.Minute), 0)
+		if at.After(t) {
+			at = localZone.Date(local.Year(), local.Month(), local.Day()-1, int(e.Hour), int(e.Minute), 0)
+		}
+		if at.After(last) {
+			last, event = at, e
+		}
+	}
+	return last, event
+}
+
+// checkRelaySchedule switches the relays whose last event was not applied
+// yet. Like the feedings, it waits for the RTC to hold a valid time. An
+// event refused by the interlocks or the thermostat of the relay is
+// reported once with a relay_rejected event, and not retried.
+func checkRelaySchedule() {
+	if !rtcTimeValid {
+		return
+	}
+	now, err := readTime()
+	if err != nil {
+		println("[RELAY] error reading date:", err)
+		return
+	}
+	changed := false
+	for i := range relaySchedule {
+		if len(relaySchedule[i]) == 0 {
+			continue
+		}
+		at, e := lastRelayEvent(relaySchedule[i], now)
+		if at.Unix() == relayLastEvent[i] {
+			continue
+		}
+		println("[RELAY] schedule", i+1, e.State, "at", localZone.In(at).Format(time.RFC3339))
+		relayLastEvent[i] = at.Unix()
+		relayOverride[i] = false
+		// relayCommand reports the interlocks itself
+		if err := relayCommand(i, e.State); err == errThermostatRelay {
+			interlockRejected(i, "schedule "+e.State, err)
+		}
+		changed = true
+	}
+	if changed {
+		sendRelayStatus()
+	}
+}
+
+// manualRelayCommand runs a command received over MQTT, it overrides the
+// schedule of the relay until its next event.
+func manualRelayCommand(i int, command string) error {
+	if err := relayCommand(i, command); err != nil {
+		return err
+	}
+	relayOverride[i] = len(relaySchedule[i]) > 0
+	return nil
+}
+
+// relayScheduleHandler sets the schedules received on
+// relayScheduleTopic/set in a protocol.SetRequest.
+func relayScheduleHandler(payload []byte) {
+	value, err := setValue(payload)
+	if err == nil {
+		err = setRelaySchedule(value)
+	}
+	if err != nil {
+		println("[RELAY]", err.Error())
+		return
+	}
+	checkRelaySchedule()
+	publishRelaySchedule()
+}
+
+func setRelaySchedule(payload []byte) error {
+	var in []*[]protocol.RelayEvent
+	if err := json.Unmarshal(payload, &in); err != nil {
+		return err
+	}
+	if len(in) > len(relaySchedule) {
+		return errInvalidRelayEvent
+	}
+	for _, events := range in {
+		if events == nil {
+			continue
+		}
+		if len(*events) > RelayEvents {
+			return errInvalidRelayEvent
+		}
+		for j := range *events {
+			e := &(*events)[j]
+			e.State = strings.ToUpper(e.State)
+			if e.Hour > 23 || e.Minute > 59 || (e.State != protocol.RelayOn && e.State != protocol.RelayOff) {
+				return errInvalidRelayEvent
+			}
+		}
+	}
+	for i, events := range in {
+		if events == nil {
+			continue
+		}
+		relaySchedule[i] = append([]protocol.RelayEvent{}, *events...)
+		relayLastEvent[i] = 0
+		relayOverride[i] = false
+		saveRelaySchedule(i)
+	}
+	return nil
+}
+
+func publishRelaySchedule() {
+	data, err = json.Marshal(relaySchedule)
+	if err != nil {
+		println("ERROR MARSHALLING RELAY SCHEDULE", err)
+		return
+	}
+	publishData(relayScheduleTopic, &data)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// relayTick is how often the main loop checks the relay timers, the
+// shortest pulse is protocol.MinRelayTimer.
+const relayTick = 50 * time.Millisecond
+
+// A relay with a timer is switched to relayRevert[i] at relayUntil[i],
+// relayLimit[i] is set when the timer is the max_on limit. The timers use
+// the monotonic clock of the board, they keep running without network nor
+// RTC.
+var (
+	relayUntil  [4]time.Time
+	relayRevert [4]bool
+	relayLimit  [4]bool
+
+	// relayChanged is when each relay last switched.
+	relayChanged [4]time.Time
+
+	errThermostatRelay = errors.New("relay driven by its thermostat")
+)
+
+func relayHandler(topics []string, payload string) {
+	if len(topics) < 4 || topics[3] != "set" {
+		return
+	}
+
+	switch topics[2] {
+	case "relay1", "relay2", "relay3", "relay4":
+		i := int(topics[2][5] - '1')
+		if topics[1] != config.Relays[i].Component {
+			return
+		}
+		if err := manualRelayCommand(i, payload); err != nil {
+			println("[RELAY]", topics[2], err.Error())
+		}
+	default:
+		break
+	}
+	sendRelayStatus()
+}
+
+// relayCommand runs a protocol.RelayCommand on the relay i.
+func relayCommand(i int, command string) error {
+	c, err := protocol.ParseRelayCommand(command)
+	if err != nil {
+		return err
+	}
+	if config.Relays[i].Thermostat != nil {
+		return errThermostatRelay
+	}
+	on := c.Action == protocol.RelayOn
+	if c.Action == protocol.RelayToggle {
+		on = !relayOn(i)
+	}
+	if err := setRelay(i, on); err != nil {
+		interlockRejected(i, c.String(), err)
+		return err
+	}
+
+	relayUntil[i] = time.Time{}
+	maxOn := time.Duration(config.Relays[i].MaxOn) * time.Second
+	switch {
+	case c.For > 0 && (!on || maxOn == 0 || c.For < maxOn):
+		relayUntil[i] = time.Now().Add(c.For)
+		relayRevert[i], relayLimit[i] = !on, false
+	case on && maxOn > 0:
+		relayUntil[i] = time.Now().Add(maxOn)
+		relayRevert[i], relayLimit[i] = false, true
+	}
+	return nil
+}
+
+// setRelay switches the relay i, it is only turned on when the interlocks
+// allow it.
+func setRelay(i int, on bool) error {
+	if on && !relayOn(i) {
+		if err := interlocked(i); err != nil {
+			return err
+		}
+	}
+	if on != relayOn(i) {
+		relayChanged[i] = time.Now()
+	}
+	relay[i].Set(on != config.Relays[i].Inverted)
+	return nil
+}
+
+// relayOn returns whether the relay i is on, the pin is low for an
+// inverted relay.
+func relayOn(i int) bool {
+	return relay[i].Get() != config.Relays[i].Inverted
+}
+
+// checkRelayTimers reverts the relays whose timer expired and publishes
+// their new state. A relay left on without timer gets one when it has a
+// max_on limit, e.g. after the limit was configured. The thermostats have
+// their own failsafe instead.
+func checkRelayTimers(now time.Time) {
+	changed := false
+	for i := range relay {
+		if relayUntil[i].IsZero() && config.Relays[i].MaxOn > 0 && config.Relays[i].Thermostat == nil && relayOn(i) {
+			relayUntil[i] = now.Add(time.Duration(config.Relays[i].MaxOn) * time.Second)
+			relayRevert[i], relayLimit[i] = false, true
+		}
+		if relayUntil[i].IsZero() || now.Before(relayUntil[i]) {
+			continue
+		}
+		relayUntil[i] = time.Time{}
+		if err := setRelay(i, relayRevert[i]); err != nil {
+			interlockRejected(i, "timer", err)
+			continue
+		}
+		changed = true
+	}
+	if changed {
+		sendRelayStatus()
+	}
+}
+
+// relayTimer is the number of seconds before the relay i reverts, rounded
+// up, 0 without timer.
+func relayTimer(i int) uint32 {
+	if relayUntil[i].IsZero() {
+		return 0
+	}
+	left := time.Until(relayUntil[i])
+	if left < 0 {
+		return 0
+	}
+	return uint32((left + time.Second - 1) / time.Second)
+}
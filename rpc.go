@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+type methodFunc func(req *protocol.Request) (interface{}, error)
+
+// method is a method of the device, announced in the device descriptor.
+type method struct {
+	protocol.Method
+	call methodFunc
+}
+
+var (
+	errUnknownMethod = errors.New("unknown method")
+	errInvalidParams = errors.New("invalid params")
+	errFeedingBusy   = errors.New("a feeding is in progress")
+)
+
+// methods lists every method the device answers to.
+var methods []method
+
+func init() {
+	methods = []method{
+		{
+			Method: protocol.Method{
+				Name:        "info",
+				Description: "Returns device info",
+			},
+			call: infoMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "status",
+				Description: "Returns the last sensor readings, the relays and the motor",
+			},
+			call: statusMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "gm",
+				Description: "Get the EEPROM",
+				Params: []protocol.Value{
+					{ID: "p", Name: "Byte position"},
+					{ID: "n", Name: "Length"},
+				},
+			},
+			call: eepromGetMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "sm",
+				Description: "Set the EEPROM",
+				Params: []protocol.Value{
+					{ID: "p", Name: "Byte position"},
+					{ID: "v", Name: "Value"},
+					{ID: "data", Name: "Block of bytes, instead of a single value"},
+					{ID: "force", Name: "Allow writing reserved regions"},
+				},
+			},
+			call: eepromSetMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "grtc",
+				Description: "Get the RTC datetime",
+			},
+			call: rtcMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "food",
+				Description: "Dispense food, the \"feeding\" event tells when it is done",
+				Params: []protocol.Value{
+					{ID: "q", Name: "Quantity", Unit: "g"},
+				},
+			},
+			call: foodMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "relay",
+				Description: "Set relay status",
+				Params: []protocol.Value{
+					{ID: "r", Name: "Relay number"},
+					{ID: "s", Name: "Command (on, off, toggle, on for 10m, pulse 500ms)"},
+				},
+			},
+			call: relayMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "config",
+				Description: "Get the configuration, params are merged into it with the token",
+			},
+			call: configMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "schedule",
+				Description: "Get the feeding schedule, params replace it with the token",
+			},
+			call: scheduleMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "relay_schedule",
+				Description: "Get the relay schedules, params replace them with the token",
+			},
+			call: relayScheduleMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "i2c",
+				Description: "Get the I2C error counters",
+				Params: []protocol.Value{
+					{ID: "scan", Name: "Scan the bus for the addresses that answer"},
+				},
+			},
+			call: i2cMethod,
+		},
+		{
+			Method: protocol.Method{
+				Name:        "sync",
+				Description: "Synchronise the RTC over SNTP",
+			},
+			call: syncMethod,
+		},
+	}
+}
+
+func findMethod(name string) (methodFunc, bool) {
+	for _, m := range methods {
+		if m.Name == name {
+			return m.call, true
+		}
+	}
+	return nil, false
+}
+
+// callHandler runs a request received on protocol.CallTopic and publishes
+// the response.
+func callHandler(payload []byte) {
+	var req protocol.Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		println("[CALL]", err.Error())
+		return
+	}
+	res := protocol.Response{ID: req.ID, Device: DeviceID, Method: req.Method}
+	if call, ok := findMethod(req.Method); ok {
+		var err error
+		res.Result, err = call(&req)
+		if err != nil {
+			res.Error = err.Error()
+		}
+	} else {
+		res.Error = errUnknownMethod.Error()
+	}
+	if res.Error != "" {
+		println("[CALL]", req.Method, res.Error)
+	}
+
+	topic := req.Reply
+	if !protocol.ValidReplyTopic(topic) {
+		topic = protocol.ReplyTopic(DeviceID)
+	}
+	data, err = json.Marshal(res)
+	if err != nil {
+		println("ERROR MARSHALLING RESPONSE", err)
+		return
+	}
+	publishData(topic, &data)
+}
+
+// params decodes the request parameters into v, no params is not an error.
+func params(req *protocol.Request, v interface{}) error {
+	if len(req.Params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Params, v); err != nil {
+		return errInvalidParams
+	}
+	return nil
+}
+
+// infoMethod returns the full device descriptor.
+func infoMethod(req *protocol.Request) (interface{}, error) {
+	return fullDescriptor(), nil
+}
+
+func statusMethod(req *protocol.Request) (interface{}, error) {
+	readRelayState()
+	motor := "OFF"
+	if motorRunning {
+		motor = "ON"
+	}
+	return protocol.Status{Sensors: sensorState, Relays: relayState, Motor: motor}, nil
+}
+
+func eepromGetMethod(req *protocol.Request) (interface{}, error) {
+	var p protocol.EEPROMRequest
+	if err := params(req, &p); err != nil {
+		return nil, err
+	}
+	p.Token = req.Token
+	return eepromGet(&p)
+}
+
+func eepromSetMethod(req *protocol.Request) (interface{}, error) {
+	var p protocol.EEPROMRequest
+	if err := params(req, &p); err != nil {
+		return nil, err
+	}
+	p.Token = req.Token
+	return eepromSet(&p)
+}
+
+func rtcMethod(req *protocol.Request) (interface{}, error) {
+	now, err := readTime()
+	if err != nil {
+		return nil, err
+	}
+	return protocol.RTCTime{
+		Timestamp: now.Format(time.RFC3339),
+		TimeValid: rtcTimeValid,
+		Local:     localZone.In(now).Format(time.RFC3339),
+	}, nil
+}
+
+func foodMethod(req *protocol.Request) (interface{}, error) {
+	var p struct {
+		Q uint32 `json:"q"`
+	}
+	if err := params(req, &p); err != nil {
+		return nil, err
+	}
+	if p.Q == 0 || p.Q > maxFeedingQuantity {
+		return nil, errInvalidParams
+	}
+	if motorRunning || pendingFeeding != 0 {
+		return nil, errFeedingBusy
+	}
+	pendingFeeding = p.Q
+	return p.Q, nil
+}
+
+func relayMethod(req *protocol.Request) (interface{}, error) {
+	var p struct {
+		R int    `json:"r"`
+		S string `json:"s"`
+	}
+	if err := params(req, &p); err != nil {
+		return nil, err
+	}
+	if p.R < 1 || p.R > len(relay) {
+		return nil, errInvalidParams
+	}
+	if err := manualRelayCommand(p.R-1, p.S); err != nil {
+		if err == protocol.ErrInvalidRelayCommand {
+			return nil, errInvalidParams
+		}
+		return nil, err
+	}
+	sendRelayStatus()
+	return relayState, nil
+}
+
+// configMethod returns the configuration, after merging the params into it
+// when there are any. Writing it needs the token.
+func configMethod(req *protocol.Request) (interface{}, error) {
+	if len(req.Params) > 0 {
+		if !authorized(req.Token) {
+			return nil, errUnauthorized
+		}
+		if err := setConfig(req.Params); err != nil {
+			return nil, err
+		}
+		publishConfig()
+	}
+	return config, nil
+}
+
+// scheduleMethod returns the alarms, after replacing them with the params
+// when there are any. Writing them needs the token.
+func scheduleMethod(req *protocol.Request) (interface{}, error) {
+	if len(req.Params) > 0 {
+		if !authorized(req.Token) {
+			return nil, errUnauthorized
+		}
+		if err := setSchedule(req.Params); err != nil {
+			return nil, err
+		}
+		checkSchedule()
+		publishSchedule()
+	}
+	return alarms[:], nil
+}
+
+// relayScheduleMethod returns the relay schedules, after setting them from
+// the params when there are any. Writing them needs the token.
+func relayScheduleMethod(req *protocol.Request) (interface{}, error) {
+	if len(req.Params) > 0 {
+		if !authorized(req.Token) {
+			return nil, errUnauthorized
+		}
+		if err := setRelaySchedule(req.Params); err != nil {
+			return nil, err
+		}
+		checkRelaySchedule()
+		publishRelaySchedule()
+	}
+	return relaySchedule, nil
+}
+
+func i2cMethod(req *protocol.Request) (interface{}, error) {
+	var p struct {
+		Scan bool `json:"scan"`
+	}
+	if err := params(req, &p); err != nil {
+		return nil, err
+	}
+	if p.Scan {
+		i2cScan()
+	}
+	return i2cState, nil
+}
+
+// syncMethod brings the next SNTP synchronisation forward to the next loop,
+// it can not run from the MQTT handler as it needs the socket.
+func syncMethod(req *protocol.Request) (interface{}, error) {
+	nextTimeSync = time.Now()
+	return "scheduled", nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+	"github.com/conejoninja/rabbit-feeder/tz"
+)
+
+const (
+	// Alarms is the number of daily feedings in the schedule region.
+	Alarms    = 2
+	AlarmSize = Alarm2 - Alarm1
+
+	// maxFeedingQuantity is the largest amount of food, in grams, a single
+	// feeding may dispense.
+	maxFeedingQuantity = 500
+	// missedFeedingWindow is how late a feeding may still be dispensed,
+	// e.g. after a power cut. Older feedings are skipped.
+	missedFeedingWindow = 2 * time.Hour
+)
+
+// Each alarm of the schedule takes AlarmSize bytes in the EEPROM:
+//
+//	Alarm1:     hour, minute, enabled, reserved
+//	LastAlarm1: last feeding, unix seconds
+//	NextAlarm1: next feeding, unix seconds
+//	Quantity1:  grams to dispense
+//
+// Next is stored as an UTC instant, it is recomputed from the local time
+// of day after every feeding and whenever the time zone changes.
+var (
+	alarms [Alarms]protocol.Alarm
+
+	// localZone converts the UTC kept by the RTC to local time, it is
+	// parsed from config.TZ.
+	localZone = tz.UTC
+
+	scheduleTopic = protocol.ScheduleTopic(DeviceID)
+
+	errInvalidAlarm = errors.New("invalid alarm")
+)
+
+func decodeAlarm(a *protocol.Alarm, b []byte) {
+	a.Hour = b[0]
+	a.Minute = b[1]
+	a.Enabled = b[2] == 1
+	a.Last = int64(binary.BigEndian.Uint64(b[LastAlarm1-Alarm1:]))
+	a.Next = int64(binary.BigEndian.Uint64(b[NextAlarm1-Alarm1:]))
+	a.Quantity = binary.BigEndian.Uint32(b[Quantity1-Alarm1:])
+	// erased EEPROM reads as 0xFF
+	if a.Hour > 23 || a.Minute > 59 || a.Quantity > maxFeedingQuantity {
+		*a = protocol.Alarm{}
+	}
+}
+
+func encodeAlarm(a *protocol.Alarm, b []byte) {
+	b[0] = a.Hour
+	b[1] = a.Minute
+	b[2] = 0
+	if a.Enabled {
+		b[2] = 1
+	}
+	b[3] = 0
+	binary.BigEndian.PutUint64(b[LastAlarm1-Alarm1:], uint64(a.Last))
+	binary.BigEndian.PutUint64(b[NextAlarm1-Alarm1:], uint64(a.Next))
+	binary.BigEndian.PutUint32(b[Quantity1-Alarm1:], a.Quantity)
+}
+
+// loadSchedule reads the alarms from the EEPROM.
+func loadSchedule() {
+	if !eepromEnabled {
+		return
+	}
+	buf := make([]byte, Alarms*AlarmSize)
+	if _, err := eeprom.ReadAt(buf, Alarm1); err != nil {
+		println("[SCHEDULE] error reading EEPROM", err)
+		return
+	}
+	for i := range alarms {
+		decodeAlarm(&alarms[i], buf[i*AlarmSize:])
+	}
+}
+
+func saveAlarm(i int) {
+	if !eepromEnabled {
+		return
+	}
+	buf := make([]byte, AlarmSize)
+	encodeAlarm(&alarms[i], buf)
+	if _, err := eeprom.WriteAt(buf, int64(Alarm1+i*AlarmSize)); err != nil {
+		println("[SCHEDULE] error writing EEPROM", err)
+	}
+}
+
+// nextFeeding returns the first instant after t at which the local clock
+// shows the alarm time. See tz.Rule.Date for the hour repeated or skipped
+// by DST: a feeding in the repeated hour happens once, on its first
+// occurrence, and a feeding in the skipped hour is moved forward by one hour.
+func nextFeeding(a *protocol.Alarm, t time.Time) time.Time {
+	local := localZone.In(t)
+	for d := 0; ; d++ {
+		next := localZone.Date(local.Year(), local.Month(), local.Day()+d, int(a.Hour), int(a.Minute), 0)
+		if next.After(t) {
+			return next
+		}
+	}
+}
+
+// resetSchedule forces the next feeding of every alarm to be recomputed,
+// after the alarms or the time zone change.
+func resetSchedule() {
+	for i := range alarms {
+		alarms[i].Next = 0
+	}
+}
+
+// checkSchedule dispenses the feedings that are due. It does nothing until
+// the RTC holds a valid time, a fallback date would feed at random hours.
+func checkSchedule() {
+	if !rtcTimeValid {
+		return
+	}
+	now, err := readTime()
+	if err != nil {
+		println("[SCHEDULE] error reading date:", err)
+		return
+	}
+	for i := range alarms {
+		a := &alarms[i]
+		if !a.Enabled {
+			continue
+		}
+		if a.Next != 0 {
+			if now.Unix() < a.Next {
+				continue
+			}
+			if now.Sub(time.Unix(a.Next, 0)) > missedFeedingWindow {
+				println("[SCHEDULE] missed feeding", i, "at", time.Unix(a.Next, 0).UTC().Format(time.RFC3339))
+				publishEvent("feeding_missed", "Scheduled feeding missed", protocol.PriorityWarning,
+					protocol.Param{Name: "alarm", Type: "int", Value: strconv.Itoa(i)},
+					protocol.Param{Name: "scheduled", Type: "timestamp", Value: time.Unix(a.Next, 0).UTC().Format(time.RFC3339)},
+				)
+			} else {
+				println("[SCHEDULE] feeding", i, a.Quantity, "g")
+				feed(a.Quantity, "schedule")
+				a.Last = now.Unix()
+			}
+		}
+		a.Next = nextFeeding(a, now).Unix()
+		println("[SCHEDULE] next feeding", i, "at", localZone.In(time.Unix(a.Next, 0)).Format(time.RFC3339))
+		saveAlarm(i)
+		publishSchedule()
+	}
+}
+
+// scheduleHandler replaces the alarms with the JSON array received on
+// scheduleTopic/set in a protocol.SetRequest. Only hour, minute, enabled and quantity are used.
+func scheduleHandler(payload []byte) {
+	value, err := setValue(payload)
+	if err == nil {
+		err = setSchedule(value)
+	}
+	if err != nil {
+		println("[SCHEDULE]", err.Error())
+		return
+	}
+	checkSchedule()
+	publishSchedule()
+}
+
+func setSchedule(payload []byte) error {
+	var in []protocol.Alarm
+	if err := json.Unmarshal(payload, &in); err != nil {
+		return err
+	}
+	if len(in) > Alarms {
+		return errInvalidAlarm
+	}
+	for _, a := range in {
+		if a.Hour > 23 || a.Minute > 59 || a.Quantity > maxFeedingQuantity {
+			return errInvalidAlarm
+		}
+	}
+	for i := range alarms {
+		a := protocol.Alarm{}
+		if i < len(in) {
+			a = protocol.Alarm{Hour: in[i].Hour, Minute: in[i].Minute, Enabled: in[i].Enabled, Quantity: in[i].Quantity}
+		}
+		a.Last = alarms[i].Last
+		alarms[i] = a
+		saveAlarm(i)
+	}
+	return nil
+}
+
+func publishSchedule() {
+	data, err = json.Marshal(alarms[:])
+	if err != nil {
+		println("ERROR MARSHALLING SCHEDULE", err)
+		return
+	}
+	publishData(scheduleTopic, &data)
+}
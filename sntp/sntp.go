@@ -0,0 +1,136 @@
+// Package sntp implements a minimal SNTPv4 client (RFC 4330) on top of any
+// packet oriented io.ReadWriter, so it works both with the wifinina UDP
+// socket and with a net.UDPConn on the host.
+package sntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Port is the well known NTP port.
+const Port = 123
+
+const (
+	packetSize    = 48
+	maxPacketSize = 512
+	// seconds between the NTP epoch (1900) and the Unix epoch (1970)
+	ntpEpochOffset = 2208988800
+
+	modeClient = 3
+	modeServer = 4
+	version    = 4
+)
+
+var (
+	ErrTimeout      = errors.New("sntp: timeout waiting for reply")
+	ErrShortPacket  = errors.New("sntp: short packet")
+	ErrBadMode      = errors.New("sntp: reply is not from a server")
+	ErrKissOfDeath  = errors.New("sntp: server sent kiss-o-death")
+	ErrBadOrigin    = errors.New("sntp: reply does not match request")
+	ErrUnsyncServer = errors.New("sntp: server is not synchronised")
+)
+
+// Result is the outcome of a single query.
+type Result struct {
+	// Time is the server time at the moment the reply was received,
+	// corrected by half the network round trip.
+	Time time.Time
+	// RoundTrip is the network delay, excluding the server processing time.
+	RoundTrip time.Duration
+	// Stratum of the server that replied.
+	Stratum uint8
+}
+
+// Query sends one request on conn and waits up to timeout for the reply.
+// Every Read must return a single datagram. Reads on conn may either block
+// or return 0 bytes when nothing has arrived yet, as the wifinina socket
+// does; a blocking conn needs a SetReadDeadline method, like net.UDPConn,
+// to give up at the timeout.
+func Query(conn io.ReadWriter, timeout time.Duration) (Result, error) {
+	var req [packetSize]byte
+	req[0] = version<<3 | modeClient
+
+	// The transmit timestamp only has to be unique, the server echoes it
+	// back as the originate timestamp of its reply.
+	t1 := time.Now()
+	origin := uint64(t1.UnixNano()) | 1
+	binary.BigEndian.PutUint64(req[40:], origin)
+
+	if d, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err := d.SetReadDeadline(t1.Add(timeout)); err != nil {
+			return Result{}, err
+		}
+	}
+	if _, err := conn.Write(req[:]); err != nil {
+		return Result{}, err
+	}
+
+	// room for the extension fields and the MAC, which are ignored
+	var resp [maxPacketSize]byte
+	for {
+		if time.Since(t1) > timeout {
+			return Result{}, ErrTimeout
+		}
+		n, err := conn.Read(resp[:])
+		if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+			return Result{}, ErrTimeout
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		if n == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		// a short datagram is an error, it is not completed by the next
+		return parse(resp[:n], origin, time.Since(t1))
+	}
+}
+
+func parse(resp []byte, origin uint64, elapsed time.Duration) (Result, error) {
+	if len(resp) < packetSize {
+		return Result{}, ErrShortPacket
+	}
+	if resp[0]&0x07 != modeServer {
+		return Result{}, ErrBadMode
+	}
+	if resp[0]>>6 == 3 {
+		return Result{}, ErrUnsyncServer
+	}
+	stratum := resp[1]
+	if stratum == 0 {
+		return Result{}, ErrKissOfDeath
+	}
+	if binary.BigEndian.Uint64(resp[24:]) != origin {
+		return Result{}, ErrBadOrigin
+	}
+
+	t2 := ntpTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := ntpTime(binary.BigEndian.Uint64(resp[40:]))
+	if t3.IsZero() {
+		return Result{}, ErrUnsyncServer
+	}
+
+	rtt := elapsed - t3.Sub(t2)
+	if rtt < 0 {
+		rtt = 0
+	}
+	return Result{
+		Time:      t3.Add(rtt / 2),
+		RoundTrip: rtt,
+		Stratum:   stratum,
+	}, nil
+}
+
+// ntpTime converts a 64 bit NTP timestamp to a time.Time in UTC.
+func ntpTime(ts uint64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	sec := int64(ts>>32) - ntpEpochOffset
+	nsec := (int64(ts&0xffffffff) * 1e9) >> 32
+	return time.Unix(sec, nsec).UTC()
+}
@@ -0,0 +1,172 @@
+package sntp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var serverTime = time.Date(2024, 3, 31, 1, 59, 30, 0, time.UTC)
+
+func ntpTimestamp(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return sec<<32 | frac
+}
+
+// reply returns a valid server answer to req.
+func reply(req []byte) []byte {
+	resp := make([]byte, packetSize)
+	resp[0] = version<<3 | modeServer
+	resp[1] = 2
+	copy(resp[24:32], req[40:48])
+	binary.BigEndian.PutUint64(resp[32:], ntpTimestamp(serverTime))
+	binary.BigEndian.PutUint64(resp[40:], ntpTimestamp(serverTime))
+	return resp
+}
+
+// pollConn reads like the wifinina socket: 0 bytes when nothing arrived.
+type pollConn struct {
+	*net.UDPConn
+}
+
+func (c pollConn) Read(b []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+	n, err := c.UDPConn.Read(b)
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return 0, nil
+	}
+	return n, err
+}
+
+// serve starts a UDP server answering one request with handle, which
+// returns nil to stay silent, and returns a connection to it.
+func serve(t *testing.T, handle func(req []byte) []byte) pollConn {
+	t.Helper()
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := srv.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := handle(buf[:n]); resp != nil {
+			srv.WriteToUDP(resp, addr)
+		}
+	}()
+	conn, err := net.DialUDP("udp", nil, srv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pollConn{conn}
+}
+
+func TestQuery(t *testing.T) {
+	var request []byte
+	conn := serve(t, func(req []byte) []byte {
+		request = append([]byte(nil), req...)
+		return reply(req)
+	})
+	res, err := Query(conn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(request) != packetSize || request[0] != version<<3|modeClient {
+		t.Errorf("request header %x", request[:1])
+	}
+	if res.Stratum != 2 {
+		t.Errorf("stratum %d, want 2", res.Stratum)
+	}
+	if d := res.Time.Sub(serverTime); d < 0 || d > time.Second {
+		t.Errorf("time %s, want %s", res.Time, serverTime)
+	}
+	if res.RoundTrip < 0 || res.RoundTrip > time.Second {
+		t.Errorf("round trip %s", res.RoundTrip)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		handle func(req []byte) []byte
+		err    error
+	}{
+		{"kiss-o-death", func(req []byte) []byte {
+			resp := reply(req)
+			resp[1] = 0
+			copy(resp[12:16], "RATE")
+			return resp
+		}, ErrKissOfDeath},
+		{"wrong originate timestamp", func(req []byte) []byte {
+			resp := reply(req)
+			resp[31] ^= 0xff
+			return resp
+		}, ErrBadOrigin},
+		{"leap indicator 3", func(req []byte) []byte {
+			resp := reply(req)
+			resp[0] |= 3 << 6
+			return resp
+		}, ErrUnsyncServer},
+		{"no transmit timestamp", func(req []byte) []byte {
+			resp := reply(req)
+			binary.BigEndian.PutUint64(resp[40:], 0)
+			return resp
+		}, ErrUnsyncServer},
+		{"client mode", func(req []byte) []byte {
+			resp := reply(req)
+			resp[0] = version<<3 | modeClient
+			return resp
+		}, ErrBadMode},
+		{"no reply", func(req []byte) []byte { return nil }, ErrTimeout},
+		{"short reply", func(req []byte) []byte { return reply(req)[:20] }, ErrShortPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Query(serve(t, tt.handle), 100*time.Millisecond)
+			if err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestQueryBlocking checks that a blocking Read gives up at the timeout.
+func TestQueryBlocking(t *testing.T) {
+	conn := serve(t, func(req []byte) []byte { return nil })
+	start := time.Now()
+	if _, err := Query(conn.UDPConn, 100*time.Millisecond); err != ErrTimeout {
+		t.Errorf("got %v, want %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %s", d)
+	}
+
+	conn = serve(t, reply)
+	if _, err := Query(conn.UDPConn, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseShortPacket(t *testing.T) {
+	if _, err := parse(make([]byte, packetSize-1), 1, 0); err != ErrShortPacket {
+		t.Errorf("got %v, want %v", err, ErrShortPacket)
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	want := time.Date(2024, 1, 1, 12, 0, 0, 500000000, time.UTC)
+	if got := ntpTime(ntpTimestamp(want)); !got.Equal(want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if !ntpTime(0).IsZero() {
+		t.Error("zero timestamp is not the zero time")
+	}
+}
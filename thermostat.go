@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// The thermostats run on every relayTick with the last good BME280
+// readings, read every minute. environmentValid is false after a failed or
+// implausible read of the temperature or the humidity.
+var (
+	environmentValid bool
+
+	// thermostatCycle is the start of the current period of the
+	// proportional mode, thermostatOnFor how long the relay is on in it.
+	thermostatCycle  [4]time.Time
+	thermostatOnFor  [4]time.Duration
+	thermostatStates [4]protocol.ThermostatState
+	// thermostatBlocked is set while the interlocks keep the relay off, the
+	// rejection is only reported once.
+	thermostatBlocked [4]bool
+)
+
+// thermostatRange returns the targets accepted for the sensor.
+func thermostatRange(sensor string) (lo, hi int32, ok bool) {
+	switch sensor {
+	case "temperature":
+		return 0, 40 * protocol.TemperatureScale, true
+	case "humidity":
+		return 0, 100 * protocol.HumidityScale, true
+	}
+	return 0, 0, false
+}
+
+// thermostatReading returns the last good reading of the sensor of t,
+// false once it failed for FailsafeAfter. The other sensor failing does
+// not matter.
+func thermostatReading(t *Thermostat, now time.Time) (int32, bool) {
+	r := &temperatureReading
+	if t.Sensor == "humidity" {
+		r = &humidityReading
+	}
+	v := r.last(now)
+	if v == nil || !r.failed.IsZero() && now.Sub(r.failed) >= time.Duration(t.FailsafeAfter)*time.Second {
+		return 0, false
+	}
+	return *v, true
+}
+
+// checkThermostats switches the relays driven by a thermostat.
+func checkThermostats(now time.Time) {
+	for i := range relay {
+		t := config.Relays[i].Thermostat
+		if t == nil {
+			continue
+		}
+		on := relayOn(i)
+		want, state := thermostatDecide(i, t, on, now)
+		// the failsafe does not wait for the minimum times
+		if want != on && !state.Failsafe {
+			since := now.Sub(relayChanged[i])
+			if on && since < time.Duration(t.MinOn)*time.Second ||
+				!on && since < time.Duration(t.MinOff)*time.Second {
+				want = on
+			}
+		}
+		blocked := false
+		if want && !on {
+			if err := interlocked(i); err != nil {
+				if !thermostatBlocked[i] {
+					interlockRejected(i, "thermostat", err)
+				}
+				blocked, want = true, false
+			}
+		}
+		thermostatBlocked[i] = blocked
+
+		switch {
+		case state.Mode == protocol.ThermostatOff:
+			state.Action = protocol.ThermostatOff
+		case !want:
+			state.Action = protocol.ThermostatIdle
+		case t.Action == protocol.ThermostatCool:
+			state.Action = protocol.ThermostatCooling
+		default:
+			state.Action = protocol.ThermostatHeating
+		}
+
+		changed := state.Action != thermostatStates[i].Action || state.Failsafe != thermostatStates[i].Failsafe
+		thermostatStates[i] = state
+		if want != on {
+			println("[THERMOSTAT]", i+1, state.Action)
+			relayUntil[i] = time.Time{}
+			setRelay(i, want)
+			sendRelayStatus()
+		}
+		if changed {
+			publishThermostat(i)
+		}
+	}
+}
+
+// thermostatDecide returns whether the relay i should be on, before the
+// minimum on and off times apply.
+func thermostatDecide(i int, t *Thermostat, on bool, now time.Time) (bool, protocol.ThermostatState) {
+	state := protocol.ThermostatState{Mode: t.Action, Sensor: t.Sensor, Target: t.Target}
+	if t.Off {
+		state.Mode = protocol.ThermostatOff
+		return false, state
+	}
+	v, ok := thermostatReading(t, now)
+	if !ok {
+		state.Failsafe = true
+		return t.Failsafe == "on", state
+	}
+	state.Current = &v
+
+	// below is how far the reading is on the side that needs the relay on
+	below := t.Target - v
+	if t.Action == protocol.ThermostatCool {
+		below = v - t.Target
+	}
+	if t.Mode == "hysteresis" {
+		switch {
+		case below >= t.Band/2:
+			return true, state
+		case below <= -t.Band/2:
+			return false, state
+		}
+		return on, state
+	}
+
+	period := time.Duration(t.Period) * time.Second
+	if thermostatCycle[i].IsZero() || now.Sub(thermostatCycle[i]) >= period {
+		duty := int64(50) + int64(below)*100/int64(t.Band)
+		if duty < 0 {
+			duty = 0
+		}
+		if duty > 100 {
+			duty = 100
+		}
+		onFor := period * time.Duration(duty) / 100
+		if onFor < time.Duration(t.MinOn)*time.Second {
+			onFor = 0
+		}
+		if period-onFor < time.Duration(t.MinOff)*time.Second {
+			onFor = period
+		}
+		thermostatCycle[i], thermostatOnFor[i] = now, onFor
+	}
+	duty := uint8(thermostatOnFor[i] * 100 / period)
+	state.Duty = &duty
+	return now.Sub(thermostatCycle[i]) < thermostatOnFor[i], state
+}
+
+// thermostatHandler runs the HVAC mode and target commands received on
+// ThermostatTopic.
+func thermostatHandler(topics []string, payload []byte) {
+	if len(topics) < 4 || topics[3] != "set" || len(topics[1]) != len("thermostat1") {
+		return
+	}
+	i := int(topics[1][len("thermostat")] - '1')
+	if i < 0 || i >= len(relay) || config.Relays[i].Thermostat == nil {
+		return
+	}
+	c := config.clone()
+	t := c.Relays[i].Thermostat
+	switch topics[2] {
+	case "mode":
+		switch string(payload) {
+		case protocol.ThermostatOff:
+			t.Off = true
+		case t.Action:
+			t.Off = false
+		default:
+			println("[THERMOSTAT] invalid mode", string(payload))
+			return
+		}
+	case "target":
+		v, err := strconv.Atoi(string(payload))
+		lo, hi, _ := thermostatRange(t.Sensor)
+		if err != nil || int32(v) < lo || int32(v) > hi {
+			println("[THERMOSTAT] invalid target", string(payload))
+			return
+		}
+		t.Target = int32(v)
+	default:
+		return
+	}
+	config = c
+	if err := saveConfig(); err != nil {
+		println("[THERMOSTAT]", err.Error())
+	}
+	thermostatCycle[i] = time.Time{}
+	checkThermostats(time.Now())
+	publishThermostat(i)
+	publishConfig()
+}
+
+func publishThermostat(i int) {
+	data, err = json.Marshal(thermostatStates[i])
+	if err != nil {
+		println("ERROR MARSHALLING THERMOSTAT", err)
+		return
+	}
+	publishData(protocol.ThermostatTopic(DeviceID, i+1), &data)
+}
+
+// publishThermostats publishes the state of every thermostat, with the
+// readings of the minute.
+func publishThermostats() {
+	for i := range relay {
+		if config.Relays[i].Thermostat != nil {
+			publishThermostat(i)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package tz evaluates POSIX TZ rule strings such as
+// "CET-1CEST,M3.5.0,M10.5.0/3". TinyGo ships no tzdata, so this is how the
+// feeder turns the UTC kept by the RTC into local time.
+package tz
+
+import (
+	"errors"
+	"time"
+)
+
+// Rule is a parsed POSIX TZ string.
+type Rule struct {
+	StdName string
+	// StdOffset and DSTOffset are in seconds east of UTC, the opposite
+	// sign of the TZ string.
+	StdOffset int
+	DSTName   string
+	DSTOffset int
+	// HasDST is false for zones without daylight saving time.
+	HasDST bool
+	Start  Transition
+	End    Transition
+}
+
+// Transition kinds, see Transition.
+const (
+	// Julian day 1..365, February 29th is never counted (Jn).
+	JulianNoLeap = iota
+	// Zero based day of the year 0..365, counting February 29th (n).
+	JulianLeap
+	// Day d (0 = Sunday) of week w (1..5, 5 = last) of month m (Mm.w.d).
+	MonthWeekDay
+)
+
+// Transition is the local time at which DST starts or ends.
+type Transition struct {
+	Kind  int
+	Day   int
+	Week  int
+	Month int
+	// Time is seconds after local midnight, it may be negative or exceed
+	// 24 hours.
+	Time int
+}
+
+var ErrInvalid = errors.New("tz: invalid TZ string")
+
+// UTC is the rule used when nothing is configured.
+var UTC = Rule{StdName: "UTC"}
+
+// Parse parses a POSIX TZ string. When DST names are given without rules the
+// US rules ("M3.2.0,M11.1.0") are assumed, as glibc does.
+func Parse(s string) (Rule, error) {
+	var r Rule
+	p := parser{s: s}
+
+	var ok bool
+	if r.StdName, ok = p.name(); !ok {
+		return Rule{}, ErrInvalid
+	}
+	off, ok := p.offset()
+	if !ok {
+		return Rule{}, ErrInvalid
+	}
+	r.StdOffset = -off
+	if p.done() {
+		return r, nil
+	}
+
+	r.HasDST = true
+	if r.DSTName, ok = p.name(); !ok {
+		return Rule{}, ErrInvalid
+	}
+	r.DSTOffset = r.StdOffset + 3600
+	if !p.done() && p.peek() != ',' {
+		if off, ok = p.offset(); !ok {
+			return Rule{}, ErrInvalid
+		}
+		r.DSTOffset = -off
+	}
+	if p.done() {
+		r.Start = Transition{Kind: MonthWeekDay, Month: 3, Week: 2, Day: 0, Time: 7200}
+		r.End = Transition{Kind: MonthWeekDay, Month: 11, Week: 1, Day: 0, Time: 7200}
+		return r, nil
+	}
+	if !p.consume(',') {
+		return Rule{}, ErrInvalid
+	}
+	if r.Start, ok = p.transition(); !ok {
+		return Rule{}, ErrInvalid
+	}
+	if !p.consume(',') {
+		return Rule{}, ErrInvalid
+	}
+	if r.End, ok = p.transition(); !ok {
+		return Rule{}, ErrInvalid
+	}
+	if !p.done() {
+		return Rule{}, ErrInvalid
+	}
+	return r, nil
+}
+
+// Offset returns the offset in seconds east of UTC in effect at instant t,
+// and whether it is daylight saving time.
+func (r *Rule) Offset(t time.Time) (offset int, dst bool) {
+	if !r.HasDST {
+		return r.StdOffset, false
+	}
+	unix := t.Unix()
+	year := time.Unix(unix+int64(r.StdOffset), 0).UTC().Year()
+	start, end := r.transitions(year)
+	if start < end {
+		dst = unix >= start && unix < end
+	} else {
+		// southern hemisphere, DST spans the new year
+		dst = !(unix >= end && unix < start)
+	}
+	if dst {
+		return r.DSTOffset, true
+	}
+	return r.StdOffset, false
+}
+
+// In returns t in the local time described by the rule.
+func (r *Rule) In(t time.Time) time.Time {
+	offset, dst := r.Offset(t)
+	name := r.StdName
+	if dst {
+		name = r.DSTName
+	}
+	return t.In(time.FixedZone(name, offset))
+}
+
+// Date returns the instant at which the local wall clock shows the given
+// date and time. Wall times that happen twice when DST ends resolve to the
+// first occurrence. Wall times skipped when DST starts are moved forward by
+// the length of the gap, so 02:30 becomes 03:30 on a one hour jump.
+func (r *Rule) Date(year int, month time.Month, day, hour, min, sec int) time.Time {
+	wall := time.Date(year, month, day, hour, min, sec, 0, time.UTC).Unix()
+	if !r.HasDST {
+		return time.Unix(wall-int64(r.StdOffset), 0).UTC()
+	}
+
+	// Try the earlier instant (larger offset) first.
+	first, second := r.DSTOffset, r.StdOffset
+	if first < second {
+		first, second = second, first
+	}
+	for _, off := range []int{first, second} {
+		t := time.Unix(wall-int64(off), 0).UTC()
+		if o, _ := r.Offset(t); o == off {
+			return t
+		}
+	}
+
+	// Neither offset matches: the wall time falls in the gap. Interpreting
+	// it with the offset in effect before the transition moves it forward.
+	return time.Unix(wall-int64(second), 0).UTC()
+}
+
+// transitions returns the UTC instants at which DST starts and ends in year.
+func (r *Rule) transitions(year int) (start, end int64) {
+	// the start is expressed in standard time, the end in DST
+	start = r.Start.unix(year) - int64(r.StdOffset)
+	end = r.End.unix(year) - int64(r.DSTOffset)
+	return start, end
+}
+
+// unix returns the transition as seconds since the epoch, local time.
+func (t Transition) unix(year int) int64 {
+	jan1 := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	var day int
+	switch t.Kind {
+	case JulianNoLeap:
+		day = t.Day - 1
+		if isLeap(year) && t.Day >= 60 {
+			day++
+		}
+	case JulianLeap:
+		day = t.Day
+	default:
+		first := time.Date(year, time.Month(t.Month), 1, 0, 0, 0, 0, time.UTC)
+		d := (t.Day - int(first.Weekday()) + 7) % 7
+		d += (t.Week - 1) * 7
+		days := daysIn(time.Month(t.Month), year)
+		for d >= days {
+			d -= 7
+		}
+		day = first.YearDay() - 1 + d
+	}
+	return jan1.Unix() + int64(day)*86400 + int64(t.Time)
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+func daysIn(m time.Month, year int) int {
+	return time.Date(year, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+func (p *parser) done() bool { return p.i >= len(p.s) }
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *parser) consume(c byte) bool {
+	if p.peek() != c {
+		return false
+	}
+	p.i++
+	return true
+}
+
+// name parses "CET" or the quoted form "<+03>".
+func (p *parser) name() (string, bool) {
+	start := p.i
+	if p.consume('<') {
+		for !p.done() && p.peek() != '>' {
+			p.i++
+		}
+		name := p.s[start+1 : p.i]
+		if !p.consume('>') || len(name) < 3 {
+			return "", false
+		}
+		return name, true
+	}
+	for c := p.peek(); (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'); c = p.peek() {
+		p.i++
+	}
+	if p.i-start < 3 {
+		return "", false
+	}
+	return p.s[start:p.i], true
+}
+
+// offset parses [+-]hh[:mm[:ss]] and returns it in seconds.
+func (p *parser) offset() (int, bool) {
+	sign := 1
+	if p.consume('-') {
+		sign = -1
+	} else {
+		p.consume('+')
+	}
+	h, ok := p.number()
+	if !ok || h > 167 {
+		return 0, false
+	}
+	secs := h * 3600
+	if p.consume(':') {
+		m, ok := p.number()
+		if !ok || m > 59 {
+			return 0, false
+		}
+		secs += m * 60
+		if p.consume(':') {
+			s, ok := p.number()
+			if !ok || s > 59 {
+				return 0, false
+			}
+			secs += s
+		}
+	}
+	return sign * secs, true
+}
+
+func (p *parser) number() (int, bool) {
+	start := p.i
+	n := 0
+	for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+		n = n*10 + int(c-'0')
+		p.i++
+	}
+	return n, p.i > start
+}
+
+// transition parses Jn, n or Mm.w.d, optionally followed by /time.
+func (p *parser) transition() (Transition, bool) {
+	var t Transition
+	var ok bool
+	switch {
+	case p.consume('J'):
+		t.Kind = JulianNoLeap
+		if t.Day, ok = p.number(); !ok || t.Day < 1 || t.Day > 365 {
+			return t, false
+		}
+	case p.consume('M'):
+		t.Kind = MonthWeekDay
+		if t.Month, ok = p.number(); !ok || t.Month < 1 || t.Month > 12 {
+			return t, false
+		}
+		if !p.consume('.') {
+			return t, false
+		}
+		if t.Week, ok = p.number(); !ok || t.Week < 1 || t.Week > 5 {
+			return t, false
+		}
+		if !p.consume('.') {
+			return t, false
+		}
+		if t.Day, ok = p.number(); !ok || t.Day > 6 {
+			return t, false
+		}
+	default:
+		t.Kind = JulianLeap
+		if t.Day, ok = p.number(); !ok || t.Day > 365 {
+			return t, false
+		}
+	}
+	t.Time = 7200
+	if p.consume('/') {
+		if t.Time, ok = p.offset(); !ok {
+			return t, false
+		}
+	}
+	return t, true
+}
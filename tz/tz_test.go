@@ -0,0 +1,133 @@
+package tz
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+var zones = []struct {
+	tz       string
+	location string
+}{
+	{"CET-1CEST,M3.5.0,M10.5.0/3", "Europe/Berlin"},
+	{"EST5EDT,M3.2.0,M11.1.0", "America/New_York"},
+	// the US rules are assumed without rules
+	{"EST5EDT", "America/New_York"},
+	// southern hemisphere, DST spans the new year
+	{"AEST-10AEDT,M10.1.0,M4.1.0/3", "Australia/Sydney"},
+	// negative DST: the standard time is the summer time
+	{"IST-1GMT0,M10.5.0,M3.5.0/1", "Europe/Dublin"},
+	{"JST-9", "Asia/Tokyo"},
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"C",
+		"CET",
+		"CET-1CEST,M3.5.0",
+		"CET-1CEST,M13.5.0,M10.5.0",
+		"CET-1CEST,M3.6.0,M10.5.0",
+		"CET-1CEST,M3.5.7,M10.5.0",
+		"CET-1CEST,M3.5.0,M10.5.0/3x",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
+
+// TestOffset compares the rules with the time zone database every hour of
+// two years.
+func TestOffset(t *testing.T) {
+	for _, z := range zones {
+		r, err := Parse(z.tz)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", z.tz, err)
+		}
+		loc, err := time.LoadLocation(z.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for u := from; u.Year() < 2026; u = u.Add(time.Hour) {
+			_, want := u.In(loc).Zone()
+			if got, _ := r.Offset(u); got != want {
+				t.Errorf("%s at %s: offset %d, want %d", z.tz, u.Format(time.RFC3339), got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestLastWeek(t *testing.T) {
+	tests := []struct {
+		tr   Transition
+		year int
+		want string
+	}{
+		// five Sundays in March 2024, four in March 2025
+		{Transition{Kind: MonthWeekDay, Month: 3, Week: 5, Day: 0}, 2024, "2024-03-31"},
+		{Transition{Kind: MonthWeekDay, Month: 3, Week: 5, Day: 0}, 2025, "2025-03-30"},
+		{Transition{Kind: MonthWeekDay, Month: 10, Week: 5, Day: 0}, 2024, "2024-10-27"},
+		{Transition{Kind: MonthWeekDay, Month: 2, Week: 5, Day: 4}, 2024, "2024-02-29"},
+		{Transition{Kind: MonthWeekDay, Month: 2, Week: 5, Day: 4}, 2023, "2023-02-23"},
+		{Transition{Kind: MonthWeekDay, Month: 9, Week: 5, Day: 1}, 2025, "2025-09-29"},
+		{Transition{Kind: JulianNoLeap, Day: 60}, 2024, "2024-03-01"},
+		{Transition{Kind: JulianLeap, Day: 59}, 2024, "2024-02-29"},
+	}
+	for _, tt := range tests {
+		got := time.Unix(tt.tr.unix(tt.year), 0).UTC().Format("2006-01-02")
+		if got != tt.want {
+			t.Errorf("%+v in %d: %s, want %s", tt.tr, tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	tests := []struct {
+		tz   string
+		wall string
+		want string
+	}{
+		// repeated hour: the first occurrence
+		{"CET-1CEST,M3.5.0,M10.5.0/3", "2024-10-27 02:30", "2024-10-27T00:30:00Z"},
+		{"EST5EDT,M3.2.0,M11.1.0", "2024-11-03 01:30", "2024-11-03T05:30:00Z"},
+		{"AEST-10AEDT,M10.1.0,M4.1.0/3", "2024-04-07 02:30", "2024-04-06T15:30:00Z"},
+		{"IST-1GMT0,M10.5.0,M3.5.0/1", "2024-10-27 01:30", "2024-10-27T00:30:00Z"},
+		// skipped hour: moved forward by the gap
+		{"CET-1CEST,M3.5.0,M10.5.0/3", "2024-03-31 02:30", "2024-03-31T01:30:00Z"},
+		{"EST5EDT,M3.2.0,M11.1.0", "2024-03-10 02:30", "2024-03-10T07:30:00Z"},
+		{"AEST-10AEDT,M10.1.0,M4.1.0/3", "2024-10-06 02:30", "2024-10-05T16:30:00Z"},
+		{"IST-1GMT0,M10.5.0,M3.5.0/1", "2024-03-31 01:30", "2024-03-31T01:30:00Z"},
+		// ordinary times
+		{"CET-1CEST,M3.5.0,M10.5.0/3", "2024-07-01 08:00", "2024-07-01T06:00:00Z"},
+		{"AEST-10AEDT,M10.1.0,M4.1.0/3", "2024-01-01 08:00", "2023-12-31T21:00:00Z"},
+		{"JST-9", "2024-01-01 08:00", "2023-12-31T23:00:00Z"},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.tz)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.tz, err)
+		}
+		w, _ := time.Parse("2006-01-02 15:04", tt.wall)
+		got := r.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0).Format(time.RFC3339)
+		if got != tt.want {
+			t.Errorf("%s %s: %s, want %s", tt.tz, tt.wall, got, tt.want)
+		}
+	}
+}
+
+// TestIn checks that In and Date agree outside the transitions.
+func TestIn(t *testing.T) {
+	r, _ := Parse("CET-1CEST,M3.5.0,M10.5.0/3")
+	u := time.Date(2024, 7, 1, 6, 0, 0, 0, time.UTC)
+	local := r.In(u)
+	if name, off := local.Zone(); name != "CEST" || off != 7200 || local.Hour() != 8 {
+		t.Errorf("In: %s %s %d", local, name, off)
+	}
+	if d := r.Date(2024, 7, 1, 8, 0, 0); !d.Equal(u) {
+		t.Errorf("Date: %s, want %s", d, u)
+	}
+}
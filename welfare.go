@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/conejoninja/rabbit-feeder/protocol"
+)
+
+// welfareHysteresis is how far below a band the heat-stress index must
+// drop before the class goes down, so a reading on the edge does not flood
+// the events.
+const welfareHysteresis = 200
+
+var (
+	welfareClass = protocol.WelfareOK
+	// welfareCooling is the relay, 1 to 4, turned on because of a
+	// dangerous reading, 0 when none.
+	welfareCooling int
+	// welfareBlocked is set while the interlocks keep the cooling relay
+	// off, the rejection is only reported once.
+	welfareBlocked bool
+
+	// the values sensorState points to while the readings are valid
+	dewPoint, absoluteHumidity, heatStress int32
+)
+
+// checkWelfare fills the values derived from the BME280 readings of
+// sensorState, classifies them and reports the changes of class.
+func checkWelfare() {
+	sensorState.DewPoint = nil
+	sensorState.AbsoluteHumidity = nil
+	sensorState.HeatStress = nil
+	sensorState.Welfare = ""
+	t, h := temperatureReading.value, humidityReading.value
+	if !environmentValid || h <= 0 {
+		return
+	}
+	dewPoint = protocol.DewPoint(t, h)
+	absoluteHumidity = protocol.AbsoluteHumidity(t, h)
+	heatStress = protocol.HeatStressIndex(t, h)
+	sensorState.DewPoint = &dewPoint
+	sensorState.AbsoluteHumidity = &absoluteHumidity
+	sensorState.HeatStress = &heatStress
+	thi := heatStress
+
+	class := welfareClassify(thi, welfareClass)
+	sensorState.Welfare = class
+	if class != welfareClass {
+		welfareClass = class
+		println("[WELFARE]", class, thi)
+
+		priority := protocol.PriorityInfo
+		switch class {
+		case protocol.WelfareWarm:
+			priority = protocol.PriorityWarning
+		case protocol.WelfareDangerous:
+			priority = protocol.PriorityCritical
+		}
+		publishEvent("welfare", "Heat stress "+class, priority,
+			protocol.Param{Name: "heat_stress", Type: "int", Value: strconv.Itoa(int(thi))},
+			protocol.Param{Name: "temperature", Type: "int", Value: strconv.Itoa(int(t))},
+			protocol.Param{Name: "humidity", Type: "int", Value: strconv.Itoa(int(h))},
+		)
+	}
+	// on every check, the interlocks may have refused the relay or
+	// something turned it off since
+	welfareCool(class == protocol.WelfareDangerous)
+}
+
+// welfareClassify returns the class of the heat-stress index thi, the
+// class only goes down once thi is welfareHysteresis below its band.
+func welfareClassify(thi int32, last string) string {
+	warm, dangerous := config.Welfare.Warm, config.Welfare.Dangerous
+	switch last {
+	case protocol.WelfareDangerous:
+		dangerous -= welfareHysteresis
+		warm -= welfareHysteresis
+	case protocol.WelfareWarm:
+		warm -= welfareHysteresis
+	}
+	switch {
+	case thi >= dangerous:
+		return protocol.WelfareDangerous
+	case thi >= warm:
+		return protocol.WelfareWarm
+	}
+	return protocol.WelfareOK
+}
+
+// welfareCool turns the cooling relay on or off, it only turns off the
+// relay it turned on. Turning it on again is harmless, the relay is left
+// alone when already on.
+func welfareCool(on bool) {
+	if !on {
+		welfareBlocked = false
+		if n := welfareCooling; relayNumber(n) {
+			welfareCooling = 0
+			if relayOn(n - 1) {
+				println("[WELFARE] cooling relay", n, "off")
+				setRelay(n-1, false)
+				sendRelayStatus()
+			}
+		}
+		return
+	}
+	n := config.Welfare.CoolingRelay
+	if !relayNumber(n) || relayOn(n-1) {
+		return
+	}
+	relayUntil[n-1] = time.Time{}
+	if err := setRelay(n-1, true); err != nil {
+		if !welfareBlocked {
+			interlockRejected(n-1, "welfare", err)
+		}
+		welfareBlocked = true
+		return
+	}
+	println("[WELFARE] cooling relay", n, "on")
+	welfareCooling, welfareBlocked = n, false
+	sendRelayStatus()
+}
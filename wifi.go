@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/json"
 	"machine"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/conejoninja/rabbit-feeder/protocol"
 	"tinygo.org/x/drivers/net/mqtt"
 	"tinygo.org/x/drivers/wifinina"
 )
@@ -28,58 +30,56 @@ var (
 
 	connectedWifi bool
 	connectedMQTT bool
-
-	relayID     string
-	relayStatus string
 )
 
-func relayHandler(topics []string, payload string) {
-	if len(topics) < 4 || topics[3] != "set" {
+// deviceHandler handles the commands sent to DeviceID/...
+func deviceHandler(topics []string, payload []byte) {
+	if len(topics) < 2 {
 		return
 	}
-
-	switch topics[2] {
-	case "relay1":
-		if payload == "ON" {
-			relay[0].High()
-		} else if payload == "OFF" {
-			relay[0].Low()
-		}
-		break
-	case "relay2":
-		if payload == "ON" {
-			relay[1].High()
-		} else if payload == "OFF" {
-			relay[1].Low()
-		}
-		break
-	case "relay3":
-		if payload == "ON" {
-			relay[2].High()
-		} else if payload == "OFF" {
-			relay[2].Low()
-		}
-		break
-	case "relay4":
-		if payload == "ON" {
-			relay[3].High()
-		} else if payload == "OFF" {
-			relay[3].Low()
-		}
-		break
-	default:
-		break
+	if topics[1] == "call" {
+		callHandler(payload)
+		return
+	}
+	if len(topics) < 3 {
+		return
+	}
+	if topics[1] == "eeprom" {
+		eepromHandler(topics[2], payload)
+		return
+	}
+	if strings.HasPrefix(topics[1], "thermostat") {
+		thermostatHandler(topics, payload)
+		return
+	}
+	if topics[2] != "set" {
+		return
+	}
+	switch topics[1] {
+	case "config":
+		configHandler(payload)
+	case "schedule":
+		scheduleHandler(payload)
+	case "relay_schedule":
+		relayScheduleHandler(payload)
 	}
-	sendRelayStatus()
 }
 
 func subHandler(client mqtt.Client, msg mqtt.Message) {
 	println("[", msg.Topic(), "] ", string(msg.Payload()))
 	topics := strings.Split(msg.Topic(), "/")
+	if topics[0] == DeviceID {
+		deviceHandler(topics, msg.Payload())
+		return
+	}
+	if msg.Topic() == protocol.DiscoveryRequestTopic {
+		publishDescriptor()
+		return
+	}
 	if topics[0] != "homeassistant" {
 		return
 	}
-	if len(topics) > 1 && topics[1] == "switch" {
+	if len(topics) > 1 && relayComponent(topics[1]) {
 		relayHandler(topics, string(msg.Payload()))
 	}
 
@@ -140,126 +140,61 @@ func connectToMQTT() {
 func publishDiscovery() {
 	// DISCOVERY MESSAGE
 	println("Marshalling Discovery Messages, if no action after this, increase stack size with --stack-size 10KB")
-	data, err = json.Marshal(Relay1Discovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token := cl.Publish(Relay1Discovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
-
-	data, err = json.Marshal(Relay2Discovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(Relay2Discovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
-
-	data, err = json.Marshal(Relay3Discovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(Relay3Discovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
-
-	data, err = json.Marshal(Relay4Discovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(Relay4Discovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
-
-	data, err = json.Marshal(TemperatureDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(TemperatureDiscovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
-
-	data, err = json.Marshal(PressureDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(PressureDiscovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
-
-	data, err = json.Marshal(HumidityDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(HumidityDiscovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
+	for _, d := range discoveries {
+		publishEntity(d.Home, d)
 	}
+	publishRelayDiscovery(nil)
+}
 
-	data, err = json.Marshal(DistanceDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(DistanceDiscovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
-	}
+// publishRelayDiscovery announces the relays and their thermostats from
+// the configuration. It removes the thermostats no longer configured, and
+// the entities of the relays whose component changed from old.
+func publishRelayDiscovery(old *Config) {
+	for i := range relay {
+		r := &config.Relays[i]
+		if old != nil && old.Relays[i].Component != r.Component {
+			publishEntity(relayHome(i+1, old.Relays[i].Component), nil)
+		}
+		d := relayDiscovery(i+1, r)
+		publishEntity(d.Home, &d)
 
-	data, err = json.Marshal(EEPROMDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(EEPROMDiscovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
+		home := "homeassistant/climate/thermostat" + strconv.Itoa(i+1)
+		if r.Thermostat == nil {
+			publishEntity(home, nil)
+			continue
+		}
+		c := climateDiscovery(i+1, r)
+		publishEntity(home, &c)
 	}
+}
 
-	data, err = json.Marshal(RTCDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
+// publishEntity publishes the discovery message of a Home Assistant
+// entity, a nil entity removes it.
+func publishEntity(home string, entity interface{}) {
+	data = nil
+	if entity != nil {
+		data, err = json.Marshal(entity)
+		if err != nil {
+			println("[DISCOVERY]", err)
+			return
+		}
 	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(RTCDiscovery.Home+"/config", 0, false, data)
+	println("[DISCOVERY]", home, string(data))
+	token := cl.Publish(home+"/config", 0, false, data)
 	token.Wait()
 	if token.Error() != nil {
 		println("[DISCOVERY]", token.Error().Error())
 	}
+}
 
-	data, err = json.Marshal(MotorDiscovery)
-	if err != nil {
-		println("[DISCOVERY]", err)
-	}
-	println("[DISCOVERY]", string(data))
-	token = cl.Publish(MotorDiscovery.Home+"/config", 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		println("[DISCOVERY]", token.Error().Error())
+// networkTime returns the time kept by the NINA firmware, which synchronises
+// its own clock once it is connected to an access point.
+func networkTime() (time.Time, bool) {
+	t, err := adaptor.GetTime()
+	if err != nil || t == 0 {
+		return time.Time{}, false
 	}
+	return time.Unix(int64(t), 0).UTC(), true
 }
 
 func publishData(topic string, data *[]byte) {